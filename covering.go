@@ -0,0 +1,193 @@
+package matching
+
+import (
+	"strings"
+	"sync"
+)
+
+// filterNode is a node in a trie of filters.
+type filterNode struct {
+	word     string
+	filter   bool
+	parent   *filterNode
+	children map[string]*filterNode
+}
+
+func newFilterNode(word string, parent *filterNode) *filterNode {
+	return &filterNode{
+		word:     word,
+		parent:   parent,
+		children: make(map[string]*filterNode),
+	}
+}
+
+// prune removes the node and any ancestors left without filters or children.
+func (n *filterNode) prune() {
+	for n.parent != nil && !n.filter && len(n.children) == 0 {
+		delete(n.parent.children, n.word)
+		n = n.parent
+	}
+}
+
+// CoveringSet maintains the smallest set of filters which covers a set of
+// filters. A filter is left out of the covering set if another filter in the
+// set matches every topic it does, e.g. "a.b" is covered by "a.*". This is
+// the set of filters which needs to be propagated to other brokers to express
+// interest in everything subscribed to locally. It is safe for concurrent use.
+type CoveringSet struct {
+	root  *filterNode
+	cover map[string]struct{}
+	mu    sync.Mutex
+}
+
+// NewCoveringSet returns an empty CoveringSet.
+func NewCoveringSet() *CoveringSet {
+	return &CoveringSet{
+		root:  newFilterNode(empty, nil),
+		cover: make(map[string]struct{}),
+	}
+}
+
+// Filters returns the filters in the covering set.
+func (c *CoveringSet) Filters() []string {
+	c.mu.Lock()
+	filters := make([]string, 0, len(c.cover))
+	for filter, _ := range c.cover {
+		filters = append(filters, filter)
+	}
+	c.mu.Unlock()
+	return filters
+}
+
+// Apply updates the set with an Event from a Watcher and returns the changes
+// to the covering set. Applying every Event from a Matcher's Watcher keeps the
+// set equal to the covering set of the Matcher's subscriptions.
+func (c *CoveringSet) Apply(e Event) (added, removed []string) {
+	if e.Type == FilterAdded {
+		return c.Add(e.Filter)
+	}
+	return c.Remove(e.Filter)
+}
+
+// Add adds the filter to the set and returns the changes to the covering set.
+// If the filter isn't already covered, it is added to the covering set and
+// any filters it covers are removed from it.
+func (c *CoveringSet) Add(filter string) (added, removed []string) {
+	filter = canonicalTopic(filter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		curr  = c.root
+		words = newTokenizer(filter)
+	)
+	for word, ok := words.next(); ok; word, ok = words.next() {
+		child, ok := curr.children[word]
+		if !ok {
+			child = newFilterNode(word, curr)
+			curr.children[word] = child
+		}
+		curr = child
+	}
+	if curr.filter {
+		// Already present.
+		return nil, nil
+	}
+	curr.filter = true
+
+	if c.coveredByOther(c.root, newTokenizer(filter), false) {
+		return nil, nil
+	}
+	c.cover[filter] = struct{}{}
+	added = []string{filter}
+	for _, covered := range c.coveredFilters(c.root, newTokenizer(filter), nil, false) {
+		if _, ok := c.cover[covered]; ok {
+			delete(c.cover, covered)
+			removed = append(removed, covered)
+		}
+	}
+	return added, removed
+}
+
+// Remove removes the filter from the set and returns the changes to the
+// covering set. If the filter was in the covering set, any filters it covered
+// which are not covered by another filter take its place.
+func (c *CoveringSet) Remove(filter string) (added, removed []string) {
+	filter = canonicalTopic(filter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		curr  = c.root
+		words = newTokenizer(filter)
+	)
+	for word, ok := words.next(); ok; word, ok = words.next() {
+		child, ok := curr.children[word]
+		if !ok {
+			return nil, nil
+		}
+		curr = child
+	}
+	if !curr.filter {
+		return nil, nil
+	}
+	curr.filter = false
+	curr.prune()
+
+	if _, ok := c.cover[filter]; !ok {
+		return nil, nil
+	}
+	delete(c.cover, filter)
+	removed = []string{filter}
+	for _, covered := range c.coveredFilters(c.root, newTokenizer(filter), nil, false) {
+		if !c.coveredByOther(c.root, newTokenizer(covered), false) {
+			c.cover[covered] = struct{}{}
+			added = append(added, covered)
+		}
+	}
+	return added, removed
+}
+
+// coveredByOther indicates if a filter other than the given one covers it.
+// Each word can be covered by the same word or a wildcard. The tokenizer is
+// passed by value so that each branch consumes its own copy. The caller must
+// hold the lock.
+func (c *CoveringSet) coveredByOther(n *filterNode, words tokenizer, widened bool) bool {
+	word, ok := words.next()
+	if !ok {
+		return n.filter && widened
+	}
+	if child, ok := n.children[word]; ok && c.coveredByOther(child, words, widened) {
+		return true
+	}
+	if word != wildcard {
+		if child, ok := n.children[wildcard]; ok && c.coveredByOther(child, words, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredFilters returns the filters other than the given one which it
+// covers. A wildcard word covers every word. The caller must hold the lock.
+func (c *CoveringSet) coveredFilters(n *filterNode, words tokenizer, path []string, narrowed bool) []string {
+	word, ok := words.next()
+	if !ok {
+		if n.filter && narrowed {
+			return []string{strings.Join(path, delimiter)}
+		}
+		return nil
+	}
+	if word != wildcard {
+		if child, ok := n.children[word]; ok {
+			return c.coveredFilters(child, words, append(path, child.word), narrowed)
+		}
+		return nil
+	}
+	var filters []string
+	for _, child := range n.children {
+		filters = append(filters, c.coveredFilters(child, words,
+			append(path, child.word), narrowed || child.word != wildcard)...)
+	}
+	return filters
+}
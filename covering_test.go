@@ -0,0 +1,98 @@
+package matching
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoveringSet(t *testing.T) {
+	assert := assert.New(t)
+	c := NewCoveringSet()
+
+	added, removed := c.Add("a.b")
+	assert.Equal([]string{"a.b"}, added)
+	assert.Empty(removed)
+
+	added, removed = c.Add("a.c")
+	assert.Equal([]string{"a.c"}, added)
+	assert.Empty(removed)
+
+	added, removed = c.Add("a.*")
+	assert.Equal([]string{"a.*"}, added)
+	assertTopics(assert, []string{"a.b", "a.c"}, removed)
+
+	added, removed = c.Add("a.d")
+	assert.Empty(added)
+	assert.Empty(removed)
+	assertTopics(assert, []string{"a.*"}, c.Filters())
+
+	added, removed = c.Remove("a.*")
+	assertTopics(assert, []string{"a.b", "a.c", "a.d"}, added)
+	assert.Equal([]string{"a.*"}, removed)
+
+	added, removed = c.Remove("a.b")
+	assert.Empty(added)
+	assert.Equal([]string{"a.b"}, removed)
+	assertTopics(assert, []string{"a.c", "a.d"}, c.Filters())
+}
+
+func TestCoveringSetWatch(t *testing.T) {
+	assert := assert.New(t)
+	m := NewTrieMatcher()
+	_, err := m.Subscribe("a.b", 0)
+	assert.NoError(err)
+	w := m.Watch()
+	defer w.Close()
+	sub, err := m.Subscribe("*.b", 1)
+	assert.NoError(err)
+	m.Unsubscribe(sub)
+
+	c := NewCoveringSet()
+	c.Apply(nextEvent(assert, w))
+	assertTopics(assert, []string{"a.b"}, c.Filters())
+	c.Apply(nextEvent(assert, w))
+	assertTopics(assert, []string{"*.b"}, c.Filters())
+	c.Apply(nextEvent(assert, w))
+	assertTopics(assert, []string{"a.b"}, c.Filters())
+}
+
+func TestCoveringSetBruteForce(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		c       = NewCoveringSet()
+		filters = make(map[string]struct{})
+		words   = []string{"a", "b", wildcard}
+	)
+	for i := 0; i < 2000; i++ {
+		parts := make([]string, 1+rand.Intn(3))
+		for j := range parts {
+			parts[j] = words[rand.Intn(len(words))]
+		}
+		filter := strings.Join(parts, delimiter)
+		if _, ok := filters[filter]; ok && rand.Intn(2) == 0 {
+			delete(filters, filter)
+			c.Remove(filter)
+		} else {
+			filters[filter] = struct{}{}
+			c.Add(filter)
+		}
+
+		expected := []string{}
+		for f, _ := range filters {
+			covered := false
+			for g, _ := range filters {
+				if g != f && covers(g, f) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				expected = append(expected, f)
+			}
+		}
+		assertTopics(assert, expected, c.Filters())
+	}
+}
@@ -1,9 +1,12 @@
 package matching
 
 import (
-	"strings"
+	"runtime"
 	"sync/atomic"
+	"time"
 	"unsafe"
+
+	"github.com/RoaringBitmap/roaring"
 )
 
 type iNode struct {
@@ -15,34 +18,27 @@ type mainNode struct {
 	tNode *tNode
 }
 
+// cNode holds the branches of a level of the trie. The branches are kept in a
+// persistent hamt, so copying a C-node to update one branch only copies the
+// path to that branch rather than the whole level.
 type cNode struct {
-	branches map[string]*branch
+	branches hamt[*branch]
 }
 
 // newCNode creates a new C-node with the given subscription path.
-func newCNode(words []string, sub Subscriber) *cNode {
+func newCNode(words []uint32, sub Subscriber) *cNode {
 	if len(words) == 1 {
-		return &cNode{
-			branches: map[string]*branch{
-				words[0]: &branch{subs: map[Subscriber]struct{}{sub: struct{}{}}},
-			},
-		}
+		br := &branch{subs: map[Subscriber]struct{}{sub: struct{}{}}}
+		return &cNode{branches: hamt[*branch]{}.with(words[0], br)}
 	}
 	nin := &iNode{main: &mainNode{cNode: newCNode(words[1:], sub)}}
-	return &cNode{
-		branches: map[string]*branch{
-			words[0]: &branch{subs: map[Subscriber]struct{}{}, iNode: nin},
-		},
-	}
+	br := &branch{subs: map[Subscriber]struct{}{}, iNode: nin}
+	return &cNode{branches: hamt[*branch]{}.with(words[0], br)}
 }
 
 // inserted returns a copy of this C-node with the specified Subscriber
 // inserted.
-func (c *cNode) inserted(words []string, sub Subscriber) *cNode {
-	branches := make(map[string]*branch, len(c.branches)+1)
-	for key, branch := range c.branches {
-		branches[key] = branch
-	}
+func (c *cNode) inserted(words []uint32, sub Subscriber) *cNode {
 	var br *branch
 	if len(words) == 1 {
 		br = &branch{subs: map[Subscriber]struct{}{sub: struct{}{}}}
@@ -52,64 +48,63 @@ func (c *cNode) inserted(words []string, sub Subscriber) *cNode {
 			iNode: &iNode{main: &mainNode{cNode: newCNode(words[1:], sub)}},
 		}
 	}
-	branches[words[0]] = br
-	return &cNode{branches: branches}
+	return &cNode{branches: c.branches.with(words[0], br)}
 }
 
 // updated returns a copy of this C-node with the specified branch updated.
-func (c *cNode) updated(word string, sub Subscriber) *cNode {
-	branches := make(map[string]*branch, len(c.branches))
-	for word, branch := range c.branches {
-		branches[word] = branch
-	}
+func (c *cNode) updated(word uint32, sub Subscriber) *cNode {
 	newBranch := &branch{subs: map[Subscriber]struct{}{sub: struct{}{}}}
-	br, ok := branches[word]
-	if ok {
+	if br := c.branches.get(word); br != nil {
 		for id, sub := range br.subs {
 			newBranch.subs[id] = sub
 		}
 		newBranch.iNode = br.iNode
 	}
-	branches[word] = newBranch
-	return &cNode{branches: branches}
+	return &cNode{branches: c.branches.with(word, newBranch)}
 }
 
 // updatedBranch returns a copy of this C-node with the specified branch
 // updated.
-func (c *cNode) updatedBranch(word string, in *iNode, br *branch) *cNode {
-	branches := make(map[string]*branch, len(c.branches))
-	for key, branch := range c.branches {
-		branches[key] = branch
-	}
-	branches[word] = br.updated(in)
-	return &cNode{branches: branches}
+func (c *cNode) updatedBranch(word uint32, in *iNode, br *branch) *cNode {
+	return &cNode{branches: c.branches.with(word, br.updated(in))}
 }
 
 // removed returns a copy of this C-node with the Subscriber removed from the
 // corresponding branch.
-func (c *cNode) removed(word string, sub Subscriber) *cNode {
-	branches := make(map[string]*branch, len(c.branches))
-	for word, branch := range c.branches {
-		branches[word] = branch
-	}
-	br, ok := branches[word]
-	if ok {
-		br = br.removed(sub)
-		if len(br.subs) == 0 && br.iNode == nil {
-			// Remove the branch if it contains no subscribers and doesn't
-			// point anywhere.
-			delete(branches, word)
-		} else {
-			branches[word] = br
-		}
+func (c *cNode) removed(word uint32, sub Subscriber) *cNode {
+	br := c.branches.get(word)
+	if br == nil {
+		return &cNode{branches: c.branches}
 	}
-	return &cNode{branches: branches}
+	br = br.removed(sub)
+	if len(br.subs) == 0 && br.iNode == nil {
+		// Remove the branch if it contains no subscribers and doesn't point
+		// anywhere.
+		return &cNode{branches: c.branches.without(word)}
+	}
+	return &cNode{branches: c.branches.with(word, br)}
 }
 
 // getBranches returns the branches for the given word. There are two possible
 // branches: exact match and single wildcard.
-func (c *cNode) getBranches(word string) (*branch, *branch) {
-	return c.branches[word], c.branches[wildcard]
+func (c *cNode) getBranches(word uint32) (*branch, *branch) {
+	return c.branches.get(word), c.branches.get(wildcardID)
+}
+
+// coveredBranches returns the words of the branches which are covered by the
+// pattern word.
+func (c *cNode) coveredBranches(pattern uint32) []uint32 {
+	if pattern != wildcardID {
+		if c.branches.get(pattern) != nil {
+			return []uint32{pattern}
+		}
+		return nil
+	}
+	words := make([]uint32, 0, c.branches.len())
+	c.branches.each(func(word uint32, _ *branch) {
+		words = append(words, word)
+	})
+	return words
 }
 
 type branch struct {
@@ -149,41 +144,197 @@ func (b *branch) subscribers() []Subscriber {
 
 type tNode struct{}
 
+// CSTrieStats are counters of the contention a cs-trie matcher has
+// encountered since it was created.
+type CSTrieStats struct {
+	// CASFailures is the number of compare-and-swaps which lost a race.
+	CASFailures uint64
+
+	// TNodeCleanups is the number of times an operation found a tombed
+	// I-node and helped to clean it up.
+	TNodeCleanups uint64
+
+	// The retries of each operation from the root of the trie.
+	SubscribeRetries          uint64
+	UnsubscribeRetries        uint64
+	UnsubscribeAllRetries     uint64
+	UnsubscribePatternRetries uint64
+	LookupRetries             uint64
+	LookupPatternRetries      uint64
+
+	// RecheckRetries is the number of retries of the rereads of the trie
+	// which keep the reverse index and Watchers in line with it.
+	RecheckRetries uint64
+}
+
+// StatsReporter is implemented by Matchers which keep CSTrieStats.
+type StatsReporter interface {
+	// Stats returns a snapshot of the Matcher's counters.
+	Stats() CSTrieStats
+}
+
+// Backoff is called before an operation is retried, with the number of
+// retries so far, starting from zero.
+type Backoff func(retry int)
+
+// ExponentialBackoff returns a Backoff which yields the processor on the
+// first retry and then sleeps for base, doubling on each further retry up to
+// max.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(retry int) {
+		if retry == 0 {
+			runtime.Gosched()
+			return
+		}
+		d := base
+		for i := 1; i < retry && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		time.Sleep(d)
+	}
+}
+
+// csTrieCounters are the live counters behind CSTrieStats.
+type csTrieCounters struct {
+	casFailures               atomic.Uint64
+	tNodeCleanups             atomic.Uint64
+	subscribeRetries          atomic.Uint64
+	unsubscribeRetries        atomic.Uint64
+	unsubscribeAllRetries     atomic.Uint64
+	unsubscribePatternRetries atomic.Uint64
+	lookupRetries             atomic.Uint64
+	lookupPatternRetries      atomic.Uint64
+	recheckRetries            atomic.Uint64
+}
+
 type csTrieMatcher struct {
 	root *iNode
+
+	// index is the reverse index from Subscribers to topics. It sits beside
+	// the trie rather than in it and is updated after the trie, from the
+	// trie as read again during the update, so that racing operations on a
+	// Subscription leave it agreeing with the trie without a lock.
+	index      syncIndex
+	watchers   *watchers
+	registry   *SubscriberRegistry
+	dictionary *wordDictionary
+
+	// backoff, if set, is called before an operation is retried.
+	backoff Backoff
+	stats   csTrieCounters
 }
 
 func NewCSTrieMatcher() Matcher {
+	return NewCSTrieMatcherWithBackoff(nil)
+}
+
+// NewCSTrieMatcherWithBackoff returns a cs-trie matcher which calls backoff
+// before retrying an operation which lost a race with another. A nil backoff
+// retries immediately.
+func NewCSTrieMatcherWithBackoff(backoff Backoff) Matcher {
 	root := &iNode{main: &mainNode{cNode: &cNode{}}}
-	return &csTrieMatcher{root: root}
+	return &csTrieMatcher{
+		root:       root,
+		watchers:   newWatchers(),
+		registry:   NewSubscriberRegistry(),
+		dictionary: newWordDictionary(),
+		backoff:    backoff,
+	}
+}
+
+// Stats returns a snapshot of the matcher's contention counters.
+func (c *csTrieMatcher) Stats() CSTrieStats {
+	return CSTrieStats{
+		CASFailures:               c.stats.casFailures.Load(),
+		TNodeCleanups:             c.stats.tNodeCleanups.Load(),
+		SubscribeRetries:          c.stats.subscribeRetries.Load(),
+		UnsubscribeRetries:        c.stats.unsubscribeRetries.Load(),
+		UnsubscribeAllRetries:     c.stats.unsubscribeAllRetries.Load(),
+		UnsubscribePatternRetries: c.stats.unsubscribePatternRetries.Load(),
+		LookupRetries:             c.stats.lookupRetries.Load(),
+		LookupPatternRetries:      c.stats.lookupPatternRetries.Load(),
+		RecheckRetries:            c.stats.recheckRetries.Load(),
+	}
+}
+
+// retry records that an operation is being retried and backs off before it
+// is. As in a ctrie, operations retry from the root without bound: a retry
+// follows either a CAS which another operation won or a T-node which the
+// retrying operation helps to clean up, so the trie as a whole always makes
+// progress. The Backoff limits the cost of contention, not the retries.
+func (c *csTrieMatcher) retry(counter *atomic.Uint64, retry int) {
+	counter.Add(1)
+	if c.backoff != nil {
+		c.backoff(retry)
+	}
+}
+
+// cas swaps the main node pointer if it still holds old, counting failures.
+func (c *csTrieMatcher) cas(ptr *unsafe.Pointer, old, new unsafe.Pointer) bool {
+	if atomic.CompareAndSwapPointer(ptr, old, new) {
+		return true
+	}
+	c.stats.casFailures.Add(1)
+	return false
+}
+
+// loadRoot returns the root I-node.
+func (c *csTrieMatcher) loadRoot() *iNode {
+	return (*iNode)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&c.root))))
 }
 
 // Subscribe adds the Subscriber to the topic and returns a Subscription.
 func (c *csTrieMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
-	var (
-		words   = strings.Split(topic, delimiter)
-		rootPtr = (*unsafe.Pointer)(unsafe.Pointer(&c.root))
-		root    = (*iNode)(atomic.LoadPointer(rootPtr))
-	)
-	if !c.iinsert(root, nil, words, sub) {
-		c.Subscribe(topic, sub)
+	topic = canonicalTopic(topic)
+	var buf [wordBufferSize]uint32
+	words := c.dictionary.intern(topic, buf[:0])
+	var first bool
+	for retry := 0; !c.iinsert(c.loadRoot(), nil, words, sub, &first); retry++ {
+		c.retry(&c.stats.subscribeRetries, retry)
 	}
+	// A concurrent Unsubscribe may have removed the Subscriber again.
+	c.reindex(topic, sub)
+	if first {
+		c.syncWatchers(topic)
+	}
+	// The index takes its own references to the words of the Subscriptions
+	// it holds, so the ones taken for the insertion are given back.
+	c.dictionary.release(topic)
 	return &Subscription{topic: topic, subscriber: sub}, nil
 }
 
-func (c *csTrieMatcher) iinsert(i, parent *iNode, words []string, sub Subscriber) bool {
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (c *csTrieMatcher) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return c.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (c *csTrieMatcher) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return c.Subscribe(joinFilter(words), sub)
+}
+
+// iinsert inserts the Subscriber at the end of the word path below the given
+// I-node, setting first if its branch had no Subscribers before. False is
+// returned if the insertion needs to be retried.
+func (c *csTrieMatcher) iinsert(i, parent *iNode, words []uint32, sub Subscriber, first *bool) bool {
 	// Linearization point.
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
 	switch {
 	case main.cNode != nil:
 		cn := main.cNode
-		if br := cn.branches[words[0]]; br == nil {
+		if br := cn.branches.get(words[0]); br == nil {
 			// If the relevant branch is not in the map, a copy of the C-node
 			// with the new entry is created. The linearization point is a
 			// successful CAS.
 			ncn := &mainNode{cNode: cn.inserted(words, sub)}
-			return atomic.CompareAndSwapPointer(
+			*first = true
+			return c.cas(
 				mainPtr, unsafe.Pointer(main), unsafe.Pointer(ncn))
 		} else {
 			// If the relevant key is present in the map, its corresponding
@@ -194,13 +345,14 @@ func (c *csTrieMatcher) iinsert(i, parent *iNode, words []string, sub Subscriber
 				if br.iNode != nil {
 					// If the branch has an I-node, iinsert is called
 					// recursively.
-					return c.iinsert(br.iNode, i, words[1:], sub)
+					return c.iinsert(br.iNode, i, words[1:], sub, first)
 				}
 				// Otherwise, an I-node which points to a new C-node must be
 				// added. The linearization point is a successful CAS.
 				nin := &iNode{main: &mainNode{cNode: newCNode(words[1:], sub)}}
 				ncn := &mainNode{cNode: cn.updatedBranch(words[0], nin, br)}
-				return atomic.CompareAndSwapPointer(
+				*first = true
+				return c.cas(
 					mainPtr, unsafe.Pointer(main), unsafe.Pointer(ncn))
 			}
 			if _, ok := br.subs[sub]; ok {
@@ -210,11 +362,12 @@ func (c *csTrieMatcher) iinsert(i, parent *iNode, words []string, sub Subscriber
 			// Insert the Subscriber by copying the C-node and updating the
 			// respective branch. The linearization point is a successful CAS.
 			ncn := &mainNode{cNode: cn.updated(words[0], sub)}
-			return atomic.CompareAndSwapPointer(
+			*first = len(br.subs) == 0
+			return c.cas(
 				mainPtr, unsafe.Pointer(main), unsafe.Pointer(ncn))
 		}
 	case main.tNode != nil:
-		clean(parent)
+		c.clean(parent)
 		return false
 	default:
 		panic("csTrie is in an invalid state")
@@ -223,17 +376,101 @@ func (c *csTrieMatcher) iinsert(i, parent *iNode, words []string, sub Subscriber
 
 // Unsubscribe removes the Subscription.
 func (c *csTrieMatcher) Unsubscribe(sub *Subscription) {
-	var (
-		words   = strings.Split(sub.topic, delimiter)
-		rootPtr = (*unsafe.Pointer)(unsafe.Pointer(&c.root))
-		root    = (*iNode)(atomic.LoadPointer(rootPtr))
-	)
-	if !c.iremove(root, nil, nil, words, 0, sub.subscriber) {
-		c.Unsubscribe(sub)
+	var buf [wordBufferSize]uint32
+	words := c.dictionary.lookup(sub.topic, buf[:0])
+	for retry := 0; !c.iremove(c.loadRoot(), nil, nil, words, 0, sub.subscriber); retry++ {
+		c.retry(&c.stats.unsubscribeRetries, retry)
+	}
+	c.unindex(sub.topic, sub.subscriber)
+}
+
+// reindex brings the index's record of the Subscription in line with the
+// trie after an operation has changed it. The index holds a reference to the
+// topic's words and the Subscriber's ID for each Subscription it records.
+func (c *csTrieMatcher) reindex(topic string, sub Subscriber) {
+	subscribed := func() bool {
+		br := c.branch(topic)
+		if br == nil {
+			return false
+		}
+		_, ok := br.subs[sub]
+		return ok
+	}
+	switch c.index.update(topic, sub, subscribed) {
+	case 1:
+		var buf [wordBufferSize]uint32
+		c.dictionary.intern(topic, buf[:0])
+		c.registry.acquire(sub)
+	case -1:
+		c.dictionary.release(topic)
+		c.registry.release(sub)
 	}
 }
 
-func (c *csTrieMatcher) iremove(i, parent, parentsParent *iNode, words []string,
+// unindex updates the index and Watchers once the Subscription has been
+// removed from the trie. A concurrent Subscribe may have inserted it again,
+// in which case it stays indexed.
+func (c *csTrieMatcher) unindex(topic string, sub Subscriber) {
+	c.reindex(topic, sub)
+	c.unwatch(topic)
+}
+
+// unwatch updates the Watchers after Subscribers have been removed from the
+// topic if it has none left. Had it gained Subscribers since, whoever added
+// the first would update the Watchers.
+func (c *csTrieMatcher) unwatch(topic string) {
+	if br := c.branch(topic); br == nil || len(br.subs) == 0 {
+		c.syncWatchers(topic)
+	}
+}
+
+// syncWatchers updates the Watchers after an operation gave the topic its
+// first or took its last Subscriber.
+func (c *csTrieMatcher) syncWatchers(topic string) {
+	c.watchers.sync(topic, func() bool {
+		br := c.branch(topic)
+		return br != nil && len(br.subs) > 0
+	})
+}
+
+// branch returns the branch at the end of the topic's word path in the trie,
+// or nil if there is none. The words are looked up afresh, since a topic's
+// words are only forgotten once no Subscription holds them, after which any
+// Subscription to it interns them anew.
+func (c *csTrieMatcher) branch(topic string) *branch {
+	var buf [wordBufferSize]uint32
+	words := c.dictionary.lookup(topic, buf[:0])
+	for retry := 0; ; retry++ {
+		if br, ok := c.ibranch(c.loadRoot(), nil, words); ok {
+			return br
+		}
+		c.retry(&c.stats.recheckRetries, retry)
+	}
+}
+
+// ibranch returns the branch at the end of the word path below the given
+// I-node, or nil if there is none. The second value is false if the
+// operation needs to be retried.
+func (c *csTrieMatcher) ibranch(i, parent *iNode, words []uint32) (*branch, bool) {
+	for {
+		mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
+		main := (*mainNode)(atomic.LoadPointer(mainPtr))
+		if main.tNode != nil {
+			c.clean(parent)
+			return nil, false
+		}
+		br := main.cNode.branches.get(words[0])
+		if br == nil || len(words) == 1 {
+			return br, true
+		}
+		if br.iNode == nil {
+			return nil, true
+		}
+		i, parent, words = br.iNode, i, words[1:]
+	}
+}
+
+func (c *csTrieMatcher) iremove(i, parent, parentsParent *iNode, words []uint32,
 	wordIdx int, sub Subscriber) bool {
 
 	// Linearization point.
@@ -242,7 +479,7 @@ func (c *csTrieMatcher) iremove(i, parent, parentsParent *iNode, words []string,
 	switch {
 	case main.cNode != nil:
 		cn := main.cNode
-		if br := cn.branches[words[wordIdx]]; br == nil {
+		if br := cn.branches.get(words[wordIdx]); br == nil {
 			// If the relevant word is not in the map, the subscription doesn't
 			// exist.
 			return true
@@ -270,7 +507,7 @@ func (c *csTrieMatcher) iremove(i, parent, parentsParent *iNode, words []string,
 			// the Subscriber from the trie - this is the linearization point.
 			ncn := cn.removed(words[wordIdx], sub)
 			cntr := c.toContracted(ncn, i)
-			if atomic.CompareAndSwapPointer(
+			if c.cas(
 				mainPtr, unsafe.Pointer(main), unsafe.Pointer(cntr)) {
 				if parent != nil {
 					mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
@@ -284,31 +521,349 @@ func (c *csTrieMatcher) iremove(i, parent, parentsParent *iNode, words []string,
 			return false
 		}
 	case main.tNode != nil:
-		clean(parent)
+		c.clean(parent)
 		return false
 	default:
 		panic("csTrie is in an invalid state")
 	}
 }
 
-// Lookup returns the Subscribers for the given topic.
-func (c *csTrieMatcher) Lookup(topic string) []Subscriber {
+// UnsubscribeAll removes all Subscriptions for the Subscriber. The trie is
+// walked once for all of the Subscriber's topics and each affected C-node is
+// replaced with a single CAS.
+func (c *csTrieMatcher) UnsubscribeAll(sub Subscriber) {
+	topics := c.index.topics(sub)
+	if len(topics) == 0 {
+		return
+	}
+	paths := newTopicTree(c.dictionary, topics)
+	for retry := 0; !c.iremoveAll(c.loadRoot(), nil, nil, noWord, paths, sub); retry++ {
+		c.retry(&c.stats.unsubscribeAllRetries, retry)
+	}
+	for _, topic := range topics {
+		c.unindex(topic, sub)
+	}
+}
+
+// iremoveAll removes the Subscriber from every path in the topic tree below
+// the given I-node. Subtrees are handled before the I-node's own C-node so
+// that contractions propagate upward. True is returned if the removal
+// completed, false if it needs to be retried.
+func (c *csTrieMatcher) iremoveAll(i, parent, parentsParent *iNode, word uint32,
+	paths *topicTree, sub Subscriber) bool {
+
+	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
+	main := (*mainNode)(atomic.LoadPointer(mainPtr))
+	if main.tNode != nil {
+		c.clean(parent)
+		return false
+	}
+	for w, child := range paths.children {
+		if len(child.children) == 0 {
+			continue
+		}
+		if br := main.cNode.branches.get(w); br != nil && br.iNode != nil {
+			if !c.iremoveAll(br.iNode, i, parent, w, child, sub) {
+				return false
+			}
+		}
+	}
+
+	// Reload the main node since contractions below may have replaced it.
+	main = (*mainNode)(atomic.LoadPointer(mainPtr))
+	switch {
+	case main.cNode != nil:
+		var (
+			cn       = main.cNode
+			branches = cn.branches
+			changed  bool
+		)
+		for w, child := range paths.children {
+			if !child.terminal {
+				continue
+			}
+			br := cn.branches.get(w)
+			if br == nil {
+				continue
+			}
+			if _, ok := br.subs[sub]; !ok {
+				continue
+			}
+			changed = true
+			br = br.removed(sub)
+			if len(br.subs) == 0 && br.iNode == nil {
+				branches = branches.without(w)
+			} else {
+				branches = branches.with(w, br)
+			}
+		}
+		if !changed {
+			// Nothing to remove at this level.
+			return true
+		}
+		cntr := c.toContracted(&cNode{branches: branches}, i)
+		if !c.cas(
+			mainPtr, unsafe.Pointer(main), unsafe.Pointer(cntr)) {
+			return false
+		}
+		if parent != nil && cntr.tNode != nil {
+			cleanParent(i, parent, parentsParent, c, word)
+		}
+		return true
+	case main.tNode != nil:
+		c.clean(parent)
+		return false
+	default:
+		panic("csTrie is in an invalid state")
+	}
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern.
+func (c *csTrieMatcher) UnsubscribeMatching(pattern string) {
+	var buf [wordBufferSize]uint32
+	c.unsubscribePattern(c.dictionary.lookup(pattern, buf[:0]), false)
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix. Each subtree the prefix leads to is detached from the
+// trie as a whole.
+func (c *csTrieMatcher) UnsubscribePrefix(prefix string) {
+	var buf [wordBufferSize]uint32
+	c.unsubscribePattern(c.dictionary.lookup(prefix, buf[:0]), true)
+}
+
+func (c *csTrieMatcher) unsubscribePattern(pattern []uint32, prefix bool) {
+	var removed []Subscription
+	for retry := 0; !c.iremovePattern(c.loadRoot(), nil, nil, noWord, pattern, nil, prefix, &removed); retry++ {
+		c.retry(&c.stats.unsubscribePatternRetries, retry)
+	}
+	// Subscriptions inserted again by a concurrent Subscribe since they were
+	// removed stay indexed.
+	topics := make(map[string]struct{})
+	for _, sub := range removed {
+		c.reindex(sub.topic, sub.subscriber)
+		topics[sub.topic] = struct{}{}
+	}
+	for topic, _ := range topics {
+		c.unwatch(topic)
+	}
+}
+
+// iremovePattern removes the Subscriptions below the given I-node which are
+// covered by the pattern and appends them to removed. True is returned if the
+// removal completed, false if it needs to be retried.
+func (c *csTrieMatcher) iremovePattern(i, parent, parentsParent *iNode, word uint32,
+	pattern, path []uint32, prefix bool, removed *[]Subscription) bool {
+
+	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
+	main := (*mainNode)(atomic.LoadPointer(mainPtr))
+	if main.tNode != nil {
+		c.clean(parent)
+		return false
+	}
+	cn := main.cNode
+	if len(pattern) > 1 {
+		// The tree must be traversed deeper along every covered branch.
+		for _, w := range cn.coveredBranches(pattern[0]) {
+			if br := cn.branches.get(w); br.iNode != nil {
+				if !c.iremovePattern(br.iNode, i, parent, w, pattern[1:],
+					append(path, w), prefix, removed) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	if prefix {
+		// Tomb every I-node below the covered branches first. Concurrent
+		// operations inside those subtrees will then retry from the root
+		// rather than writing to a subtree which is about to be detached.
+		for _, w := range cn.coveredBranches(pattern[0]) {
+			if br := cn.branches.get(w); br.iNode != nil {
+				c.tombSubtree(br.iNode, append(path, w), removed)
+			}
+		}
+		main = (*mainNode)(atomic.LoadPointer(mainPtr))
+		if main.tNode != nil {
+			c.clean(parent)
+			return false
+		}
+		cn = main.cNode
+	}
+
 	var (
-		words   = strings.Split(topic, delimiter)
-		rootPtr = (*unsafe.Pointer)(unsafe.Pointer(&c.root))
-		root    = (*iNode)(atomic.LoadPointer(rootPtr))
+		words    = cn.coveredBranches(pattern[0])
+		branches = cn.branches
+		subs     []Subscription
 	)
-	result, ok := c.ilookup(root, nil, words)
-	if !ok {
-		return c.Lookup(topic)
+	for _, w := range words {
+		br := cn.branches.get(w)
+		if prefix && br.iNode != nil {
+			if main := (*mainNode)(atomic.LoadPointer(
+				(*unsafe.Pointer)(unsafe.Pointer(&br.iNode.main)))); main.tNode == nil {
+				// The branch was recreated after its subtree was tombed.
+				return false
+			}
+		}
+		if len(br.subs) > 0 {
+			topic, ok := c.dictionary.join(append(path, w))
+			if !ok {
+				// Words are only forgotten once their Subscriptions have been
+				// removed, so the C-node is stale.
+				return false
+			}
+			for sub, _ := range br.subs {
+				subs = append(subs, Subscription{topic: topic, subscriber: sub})
+			}
+		}
+		switch {
+		case prefix || (len(br.subs) > 0 && br.iNode == nil):
+			// Detach the branch entirely.
+			branches = branches.without(w)
+		case len(br.subs) > 0:
+			branches = branches.with(w, &branch{subs: make(map[Subscriber]struct{}), iNode: br.iNode})
+		}
+	}
+	if len(subs) == 0 && (!prefix || len(words) == 0) {
+		// Nothing to remove at this level.
+		return true
+	}
+
+	// A successful CAS removes every covered branch at once - this is the
+	// linearization point.
+	cntr := c.toContracted(&cNode{branches: branches}, i)
+	if !c.cas(
+		mainPtr, unsafe.Pointer(main), unsafe.Pointer(cntr)) {
+		return false
+	}
+	*removed = append(*removed, subs...)
+	if parent != nil && cntr.tNode != nil {
+		cleanParent(i, parent, parentsParent, c, word)
+	}
+	return true
+}
+
+// tombSubtree replaces the main node of every I-node in the subtree rooted at
+// the given I-node with a T-node, top down, and appends the Subscriptions it
+// contained to removed. If the branch pointing to the subtree gains
+// Subscribers before it is detached, toCompressed keeps the branch and only
+// drops its tombed I-node.
+func (c *csTrieMatcher) tombSubtree(i *iNode, path []uint32, removed *[]Subscription) {
+	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
+	for {
+		main := (*mainNode)(atomic.LoadPointer(mainPtr))
+		if main.tNode != nil {
+			return
+		}
+		if !c.cas(mainPtr, unsafe.Pointer(main),
+			unsafe.Pointer(&mainNode{tNode: &tNode{}})) {
+			continue
+		}
+		main.cNode.branches.each(func(word uint32, br *branch) {
+			// The words are forgotten if a concurrent operation has detached
+			// the subtree and unindexed the Subscriptions already.
+			if topic, ok := c.dictionary.join(append(path, word)); ok {
+				for sub, _ := range br.subs {
+					*removed = append(*removed, Subscription{topic: topic, subscriber: sub})
+				}
+			}
+			if br.iNode != nil {
+				c.tombSubtree(br.iNode, append(path, word), removed)
+			}
+		})
+		return
 	}
-	return result
+}
+
+// Topics returns the topics the Subscriber is subscribed to.
+func (c *csTrieMatcher) Topics(sub Subscriber) []string {
+	return c.index.topics(sub)
+}
+
+// Watch returns a Watcher which receives filter-level change Events.
+func (c *csTrieMatcher) Watch() *Watcher {
+	return c.watchers.watch()
+}
+
+// topicTree groups a set of topics by common prefix so that a trie can be
+// traversed once for all of them.
+type topicTree struct {
+	terminal bool
+	children map[uint32]*topicTree
+}
+
+// newTopicTree builds a topicTree containing the given topics, whose words
+// are looked up in the dictionary.
+func newTopicTree(d *wordDictionary, topics []string) *topicTree {
+	root := &topicTree{children: make(map[uint32]*topicTree)}
+	for _, topic := range topics {
+		curr := root
+		var buf [wordBufferSize]uint32
+		for _, word := range d.lookup(topic, buf[:0]) {
+			child, ok := curr.children[word]
+			if !ok {
+				child = &topicTree{children: make(map[uint32]*topicTree)}
+				curr.children[word] = child
+			}
+			curr = child
+		}
+		curr.terminal = true
+	}
+	return root
+}
+
+// Lookup returns the Subscribers for the given topic.
+func (c *csTrieMatcher) Lookup(topic string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return c.lookupIDs(c.dictionary.lookup(topic, buf[:0]))
+}
+
+// lookupIDs returns the Subscribers for the topic made of the words with the
+// given IDs.
+func (c *csTrieMatcher) lookupIDs(words []uint32) []Subscriber {
+	for retry := 0; ; retry++ {
+		if result, ok := c.ilookup(c.loadRoot(), nil, words); ok {
+			return result
+		}
+		c.retry(&c.stats.lookupRetries, retry)
+	}
+}
+
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (c *csTrieMatcher) LookupBytes(topic []byte) []Subscriber {
+	return c.Lookup(bytesToString(topic))
+}
+
+// LookupWords returns the Subscribers for the topic made of the words.
+func (c *csTrieMatcher) LookupWords(words []string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return c.lookupIDs(c.dictionary.lookupWords(words, buf[:0]))
+}
+
+// LookupBitmap returns the IDs of the Subscribers for the given topic.
+func (c *csTrieMatcher) LookupBitmap(topic string) *roaring.Bitmap {
+	ids := roaring.New()
+	for _, sub := range c.Lookup(topic) {
+		// Subscribers whose last Subscription was removed since are skipped.
+		if id, ok := c.registry.ID(sub); ok {
+			ids.Add(id)
+		}
+	}
+	return ids
+}
+
+// Registry returns the SubscriberRegistry which assigns Subscriber IDs.
+func (c *csTrieMatcher) Registry() *SubscriberRegistry {
+	return c.registry
 }
 
 // ilookup attempts to retrieve the Subscribers for the word path. True is
 // returned if the Subscribers were retrieved, false if the operation needs to
 // be retried.
-func (c *csTrieMatcher) ilookup(i, parent *iNode, words []string) ([]Subscriber, bool) {
+func (c *csTrieMatcher) ilookup(i, parent *iNode, words []uint32) ([]Subscriber, bool) {
 	// Linearization point.
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
@@ -343,7 +898,7 @@ func (c *csTrieMatcher) ilookup(i, parent *iNode, words []string) ([]Subscriber,
 		}
 		return s, true
 	case main.tNode != nil:
-		clean(parent)
+		c.clean(parent)
 		return nil, false
 	default:
 		panic("csTrie is in an invalid state")
@@ -354,7 +909,7 @@ func (c *csTrieMatcher) ilookup(i, parent *iNode, words []string) ([]Subscriber,
 // given branch. True is returned if the Subscribers were retrieved, false if
 // the operation needs to be retried.
 func (c *csTrieMatcher) bLookup(i, parent *iNode, main *mainNode, b *branch,
-	words []string) ([]Subscriber, bool) {
+	words []uint32) ([]Subscriber, bool) {
 
 	if len(words) > 1 {
 		// If more than 1 key is present in the path, the tree must be
@@ -380,11 +935,74 @@ func (c *csTrieMatcher) bLookup(i, parent *iNode, main *mainNode, b *branch,
 	return b.subscribers(), true
 }
 
+// LookupPattern returns the Subscribers whose topic overlaps the filter.
+func (c *csTrieMatcher) LookupPattern(filter string) []Subscriber {
+	var (
+		buf   [wordBufferSize]uint32
+		words = c.dictionary.lookup(filter, buf[:0])
+		subs  = make(map[Subscriber]struct{})
+	)
+	for retry := 0; !c.ilookupPattern(c.loadRoot(), nil, words, subs); retry++ {
+		c.retry(&c.stats.lookupPatternRetries, retry)
+		subs = make(map[Subscriber]struct{})
+	}
+	s := make([]Subscriber, len(subs))
+	i := 0
+	for sub, _ := range subs {
+		s[i] = sub
+		i++
+	}
+	return s
+}
+
+// ilookupPattern adds the Subscribers below the given I-node whose topics
+// overlap the filter words to subs. Every branch is followed where the filter
+// has a wildcard. True is returned if the Subscribers were retrieved, false if
+// the operation needs to be retried.
+func (c *csTrieMatcher) ilookupPattern(i, parent *iNode, words []uint32,
+	subs map[Subscriber]struct{}) bool {
+
+	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
+	main := (*mainNode)(atomic.LoadPointer(mainPtr))
+	switch {
+	case main.cNode != nil:
+		var branches []*branch
+		if words[0] == wildcardID {
+			branches = make([]*branch, 0, main.cNode.branches.len())
+			main.cNode.branches.each(func(_ uint32, br *branch) {
+				branches = append(branches, br)
+			})
+		} else {
+			exact, singleWC := main.cNode.getBranches(words[0])
+			branches = []*branch{exact, singleWC}
+		}
+		for _, br := range branches {
+			switch {
+			case br == nil:
+			case len(words) == 1:
+				for sub, _ := range br.subs {
+					subs[sub] = struct{}{}
+				}
+			case br.iNode != nil:
+				if !c.ilookupPattern(br.iNode, i, words[1:], subs) {
+					return false
+				}
+			}
+		}
+		return true
+	case main.tNode != nil:
+		c.clean(parent)
+		return false
+	default:
+		panic("csTrie is in an invalid state")
+	}
+}
+
 // toContracted ensures that every I-node except the root points to a C-node
 // with at least one branch or a T-node. If a given C-node has no branches and
 // is not at the root level, a T-node is returned.
 func (c *csTrieMatcher) toContracted(cn *cNode, parent *iNode) *mainNode {
-	if c.root != parent && len(cn.branches) == 0 {
+	if c.root != parent && cn.branches.len() == 0 {
 		return &mainNode{tNode: &tNode{}}
 	}
 	return &mainNode{cNode: cn}
@@ -392,11 +1010,12 @@ func (c *csTrieMatcher) toContracted(cn *cNode, parent *iNode) *mainNode {
 
 // clean replaces an I-node's C-node with a copy that has any tombed I-nodes
 // resurrected.
-func clean(i *iNode) {
+func (c *csTrieMatcher) clean(i *iNode) {
+	c.stats.tNodeCleanups.Add(1)
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
 	if main.cNode != nil {
-		atomic.CompareAndSwapPointer(mainPtr,
+		c.cas(mainPtr,
 			unsafe.Pointer(main), unsafe.Pointer(toCompressed(main.cNode)))
 	}
 }
@@ -404,24 +1023,29 @@ func clean(i *iNode) {
 // cleanParent reads the main node of the parent I-node p and the current
 // I-node i and checks if the T-node below i is reachable from p. If i is no
 // longer reachable, some other thread has already completed the contraction.
-// If it is reachable, the C-node below p is replaced with its contraction.
-func cleanParent(i, parent, parentsParent *iNode, c *csTrieMatcher, word string) {
+// If it is reachable, the C-node below p is replaced with its contraction,
+// which is retried with the same I-nodes until it succeeds or i is no longer
+// reachable. The retries aren't bounded, but each follows a CAS on p or its
+// parent which another operation won, so the trie as a whole always makes
+// progress, and i is unreachable once any operation has contracted it.
+func cleanParent(i, parent, parentsParent *iNode, c *csTrieMatcher, word uint32) {
 	var (
 		mainPtr  = (*unsafe.Pointer)(unsafe.Pointer(&i.main))
-		main     = (*mainNode)(atomic.LoadPointer(mainPtr))
 		pMainPtr = (*unsafe.Pointer)(unsafe.Pointer(&parent.main))
-		pMain    = (*mainNode)(atomic.LoadPointer(pMainPtr))
 	)
-	if pMain.cNode != nil {
-		if br, ok := pMain.cNode.branches[word]; ok {
-			if br.iNode != i {
-				return
-			}
-			if main.tNode != nil {
-				if !contract(parentsParent, parent, i, c, pMain) {
-					cleanParent(parentsParent, parent, i, c, word)
-				}
-			}
+	for {
+		var (
+			main  = (*mainNode)(atomic.LoadPointer(mainPtr))
+			pMain = (*mainNode)(atomic.LoadPointer(pMainPtr))
+		)
+		if pMain.cNode == nil || main.tNode == nil {
+			return
+		}
+		if br := pMain.cNode.branches.get(word); br == nil || br.iNode != i {
+			return
+		}
+		if contract(parentsParent, parent, i, c, pMain) {
+			return
 		}
 	}
 }
@@ -430,33 +1054,40 @@ func cleanParent(i, parent, parentsParent *iNode, c *csTrieMatcher, word string)
 // true if the contraction succeeded, false if it needs to be retried.
 func contract(parentsParent, parent, i *iNode, c *csTrieMatcher, pMain *mainNode) bool {
 	ncn := toCompressed(pMain.cNode)
-	if len(ncn.cNode.branches) == 0 && parentsParent != nil {
+	if ncn.cNode.branches.len() == 0 && parentsParent != nil {
 		// If the compressed C-node has no branches, it and the I-node above it
 		// should be removed. To do this, a CAS must occur on the parent I-node
 		// of the parent to update the respective branch of the C-node below it
 		// to point to nil.
 		ppMainPtr := (*unsafe.Pointer)(unsafe.Pointer(&parentsParent.main))
 		ppMain := (*mainNode)(atomic.LoadPointer(ppMainPtr))
-		for pKey, pBranch := range ppMain.cNode.branches {
-			// Find the branch pointing to the parent.
-			if pBranch.iNode == parent {
-				// Update the branch to point to nil.
-				updated := ppMain.cNode.updatedBranch(pKey, nil, pBranch)
-				if len(pBranch.subs) == 0 {
-					// If the branch has no subscribers, simply prune it.
-					delete(updated.branches, pKey)
-				}
-				// Replace the main node of the parent's parent.
-				return atomic.CompareAndSwapPointer(ppMainPtr,
-					unsafe.Pointer(ppMain), unsafe.Pointer(toCompressed(updated)))
+		// Find the branch pointing to the parent.
+		var (
+			pKey    uint32
+			pBranch *branch
+		)
+		ppMain.cNode.branches.each(func(word uint32, br *branch) {
+			if br.iNode == parent {
+				pKey, pBranch = word, br
 			}
+		})
+		if pBranch != nil {
+			// Update the branch to point to nil.
+			updated := ppMain.cNode.updatedBranch(pKey, nil, pBranch)
+			if len(pBranch.subs) == 0 {
+				// If the branch has no subscribers, simply prune it.
+				updated.branches = updated.branches.without(pKey)
+			}
+			// Replace the main node of the parent's parent.
+			return c.cas(ppMainPtr,
+				unsafe.Pointer(ppMain), unsafe.Pointer(toCompressed(updated)))
 		}
 	} else {
 		// Otherwise, perform a simple contraction to a T-node.
 		cntr := c.toContracted(ncn.cNode, parent)
 		pMainPtr := (*unsafe.Pointer)(unsafe.Pointer(&parent.main))
 		pMain := (*mainNode)(atomic.LoadPointer(pMainPtr))
-		if !atomic.CompareAndSwapPointer(pMainPtr, unsafe.Pointer(pMain),
+		if !c.cas(pMainPtr, unsafe.Pointer(pMain),
 			unsafe.Pointer(cntr)) {
 			return false
 		}
@@ -465,14 +1096,24 @@ func contract(parentsParent, parent, i *iNode, c *csTrieMatcher, pMain *mainNode
 }
 
 // toCompressed prunes any branches to tombed I-nodes and returns the
-// compressed main node.
+// compressed main node. Unlike a ctrie, whose T-nodes hold the entry of the
+// single leaf left in a subtree, T-nodes here are empty: a subtree is only
+// tombed once it has no Subscribers left, either because its last
+// Subscription was removed or because a prefix removal detached the whole
+// subtree, whose Subscriptions that removal has already accounted for. There
+// is therefore nothing to resurrect as a leaf. A branch which has gained
+// Subscribers of its own in the meantime keeps them, and only its dead I-node
+// is dropped so that the branch becomes a leaf again.
 func toCompressed(cn *cNode) *mainNode {
-	branches := make(map[string]*branch, len(cn.branches))
-	for key, br := range cn.branches {
-		if !prunable(br) {
-			branches[key] = br
+	branches := cn.branches
+	cn.branches.each(func(key uint32, br *branch) {
+		switch {
+		case prunable(br):
+			branches = branches.without(key)
+		case tombed(br.iNode):
+			branches = branches.with(key, br.updated(nil))
 		}
-	}
+	})
 	return &mainNode{cNode: &cNode{branches: branches}}
 }
 
@@ -483,10 +1124,15 @@ func prunable(br *branch) bool {
 	if len(br.subs) > 0 {
 		return false
 	}
-	if br.iNode == nil {
-		return true
+	return br.iNode == nil || tombed(br.iNode)
+}
+
+// tombed indicates if the I-node is non-nil and points to a T-node.
+func tombed(i *iNode) bool {
+	if i == nil {
+		return false
 	}
-	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&br.iNode.main))
+	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
 	return main.tNode != nil
 }
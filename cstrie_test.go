@@ -1,7 +1,12 @@
 package matching
 
 import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -51,6 +56,109 @@ func TestCSTrieMatcher(t *testing.T) {
 	assertEqual(assert, []Subscriber{}, m.Lookup("trade"))
 }
 
+func TestCSTrieMatcherConcurrentPrefixRemoval(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		m    = NewCSTrieMatcher()
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	// The subtree below "orders" is tombed and contracted away repeatedly,
+	// but the branch itself keeps its Subscriber.
+	_, err := m.Subscribe("orders", "keep")
+	assert.NoError(err)
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			m.UnsubscribePrefix("orders.*")
+			runtime.Gosched()
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				// Subscribing twice races the removal of an existing
+				// Subscription with its reinsertion.
+				topic := "orders." + strconv.Itoa(j) + ".new"
+				_, err := m.Subscribe(topic, i)
+				assert.NoError(err)
+				_, err = m.Subscribe(topic, i)
+				assert.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	<-done
+
+	assertEqual(assert, []Subscriber{"keep"}, m.Lookup("orders"))
+	// The reverse index agrees with the trie about every Subscription.
+	for i := 0; i < 4; i++ {
+		var expected []string
+		for j := 0; j < 200; j++ {
+			topic := "orders." + strconv.Itoa(j) + ".new"
+			for _, sub := range m.Lookup(topic) {
+				if sub == i {
+					expected = append(expected, topic)
+				}
+			}
+		}
+		assertTopics(assert, expected, m.Topics(i))
+	}
+}
+
+func TestCSTrieMatcherStats(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		backoffs int64
+		m        = NewCSTrieMatcherWithBackoff(func(retry int) {
+			atomic.AddInt64(&backoffs, 1)
+			runtime.Gosched()
+		})
+		wg sync.WaitGroup
+	)
+
+	_, err := m.Subscribe("a.b", 0)
+	assert.NoError(err)
+	assert.Equal(CSTrieStats{}, m.(StatsReporter).Stats())
+
+	// Contend on the same C-nodes so that some operations lose races.
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				sub, err := m.Subscribe("a.b.c", i)
+				assert.NoError(err)
+				m.Lookup("a.b.c")
+				m.Unsubscribe(sub)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := m.(StatsReporter).Stats()
+	retries := stats.SubscribeRetries + stats.UnsubscribeRetries + stats.LookupRetries +
+		stats.RecheckRetries
+	assert.Equal(uint64(atomic.LoadInt64(&backoffs)), retries)
+	assertEqual(assert, []Subscriber{0}, m.Lookup("a.b"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("a.b.c"))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	assert := assert.New(t)
+	backoff := ExponentialBackoff(time.Millisecond, 4*time.Millisecond)
+
+	start := time.Now()
+	backoff(0)
+	backoff(1)
+	backoff(5)
+	elapsed := time.Since(start)
+	assert.True(elapsed >= 5*time.Millisecond, "elapsed %s", elapsed)
+}
+
 func BenchmarkCSTrieMatcherSubscribe(b *testing.B) {
 	var (
 		m  = NewCSTrieMatcher()
@@ -130,6 +238,45 @@ func BenchmarkCSTrieMatcherLookupCold(b *testing.B) {
 	}
 }
 
+func BenchmarkCSTrieMatcherSubscribeWide(b *testing.B) {
+	m := NewCSTrieMatcher()
+	populateWideMatcher(m, "device", 50000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Subscribe("device."+strconv.Itoa(i%50000), i)
+	}
+}
+
+func BenchmarkCSTrieMatcherUnsubscribeWide(b *testing.B) {
+	var (
+		m  = NewCSTrieMatcher()
+		s0 = 0
+	)
+	populateWideMatcher(m, "device", 50000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sub, _ := m.Subscribe("device."+strconv.Itoa(i%50000), s0)
+		b.StartTimer()
+		m.Unsubscribe(sub)
+	}
+}
+
+func BenchmarkCSTrieMatcherLookupWide(b *testing.B) {
+	m := NewCSTrieMatcher()
+	populateWideMatcher(m, "device", 50000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Lookup("device." + strconv.Itoa(i%50000))
+	}
+}
+
 func BenchmarkMultithreaded1Thread5050CSTrie(b *testing.B) {
 	numItems := 1000
 	numThreads := 1
@@ -0,0 +1,232 @@
+package matching
+
+import (
+	"hash/maphash"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// noWord is the ID of a word which hasn't been interned. No matcher
+	// indexes it, so a lookup of an unseen word can only follow wildcards.
+	noWord uint32 = 0
+
+	// wildcardID is the ID of the wildcard word.
+	wildcardID uint32 = 1
+)
+
+// wordBufferSize is the number of word IDs matchers make room for on the stack
+// when tokenizing a topic. Longer topics spill onto the heap.
+const wordBufferSize = 16
+
+// emptyWords are the words of the empty topic.
+var emptyWords = []string{empty}
+
+// wordDictionary interns topic words, assigning each distinct word a uint32
+// ID, so that matchers tokenize a topic once and then key their levels on
+// integers rather than hashing the words again at every level. Each matcher
+// has its own dictionary. Words are reference counted by the topics which
+// intern them and forgotten once the last is released, so the dictionary only
+// holds the words which are subscribed to. Lookups, joins and references to
+// words which are already interned don't lock. Adding an unseen word and
+// forgetting one serialize on a mutex and publish a new wordMap. It is safe
+// for concurrent use.
+type wordDictionary struct {
+	ids  atomic.Pointer[wordMap]
+	seed maphash.Seed
+
+	// words maps the IDs of interned words to them.
+	words sync.Map
+
+	// size, next and limit are guarded by mu.
+	size  int
+	next  uint32
+	limit uint32
+	mu    sync.Mutex
+}
+
+// internedWord is an interned word, its ID and the number of references to
+// it. A word whose references drop to zero is never revived, so it can be
+// forgotten without racing a concurrent intern, which interns the word anew.
+type internedWord struct {
+	word string
+	id   uint32
+	refs atomic.Int64
+}
+
+func newWordDictionary() *wordDictionary {
+	d := &wordDictionary{
+		seed:  maphash.MakeSeed(),
+		size:  1,
+		next:  wildcardID + 1,
+		limit: math.MaxUint32,
+	}
+	w := &internedWord{word: wildcard, id: wildcardID}
+	d.words.Store(wildcardID, w)
+	ids := wordMap{}.with(d.hash(wildcard), w)
+	d.ids.Store(&ids)
+	return d
+}
+
+// hash returns the hash of the word in the dictionary's wordMap.
+func (d *wordDictionary) hash(word string) uint64 {
+	return maphash.String(d.seed, word)
+}
+
+// intern appends the IDs of the topic's words to ids, interning any unseen
+// ones, and returns the extended slice. Each word gains a reference, which
+// the caller gives back with release once it no longer indexes the topic.
+// Subscriptions intern their topics so that the words can be indexed.
+func (d *wordDictionary) intern(topic string, ids []uint32) []uint32 {
+	words := newTokenizer(topic)
+	for word, ok := words.next(); ok; word, ok = words.next() {
+		ids = append(ids, d.acquire(word))
+	}
+	return ids
+}
+
+// release gives back the references intern took on the topic's words,
+// forgetting the words left without any.
+func (d *wordDictionary) release(topic string) {
+	words := newTokenizer(topic)
+	for word, ok := words.next(); ok; word, ok = words.next() {
+		hash := d.hash(word)
+		// The topic holds a reference, so the word can't have been replaced.
+		w := d.ids.Load().get(hash, word)
+		if w == nil || w.id == wildcardID || w.refs.Add(-1) != 0 {
+			continue
+		}
+
+		d.mu.Lock()
+		if ids := d.ids.Load(); ids.get(hash, word) == w {
+			next := ids.without(hash, word)
+			d.ids.Store(&next)
+		}
+		d.words.Delete(w.id)
+		d.size--
+		d.mu.Unlock()
+	}
+}
+
+// acquire returns the ID of the word and takes a reference to it, assigning
+// it an ID if it is unseen. The wildcard is never forgotten, so it isn't
+// counted. Only unseen words, or ones being forgotten, take the lock.
+func (d *wordDictionary) acquire(word string) uint32 {
+	hash := d.hash(word)
+	if w := d.ids.Load().get(hash, word); w != nil && w.tryAcquire() {
+		return w.id
+	}
+
+	d.mu.Lock()
+	// Unlocked by a deferred call since nextID panics when IDs run out.
+	defer d.mu.Unlock()
+	ids := d.ids.Load()
+	if w := ids.get(hash, word); w != nil && w.tryAcquire() {
+		return w.id
+	}
+	// The word is copied so that the dictionary doesn't pin the rest of the
+	// topic, or a buffer it aliases, in memory. A word being forgotten is
+	// replaced, and its ID freed once its release takes the lock.
+	w := &internedWord{word: strings.Clone(word), id: d.nextID()}
+	w.refs.Store(1)
+	d.words.Store(w.id, w)
+	d.size++
+	next := ids.with(hash, w)
+	d.ids.Store(&next)
+	return w.id
+}
+
+// tryAcquire takes a reference to the word unless it has been released. The
+// wildcard isn't counted, so it always succeeds.
+func (w *internedWord) tryAcquire() bool {
+	if w.id == wildcardID {
+		return true
+	}
+	for {
+		refs := w.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if w.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// nextID returns an unassigned ID. IDs are assigned in order, wrapping around
+// past the limit and skipping noWord and the IDs in use, so a forgotten
+// word's ID is only assigned again once every other ID has been. A lookup
+// which read the ID just before the word was forgotten therefore can't
+// mistake another word for it. It panics if every ID is in use. The caller
+// must hold the lock.
+func (d *wordDictionary) nextID() uint32 {
+	if uint64(d.size) >= uint64(d.limit) {
+		panic("matching: word dictionary has no IDs left")
+	}
+	for {
+		id := d.next
+		if id == d.limit {
+			d.next = wildcardID + 1
+		} else {
+			d.next++
+		}
+		if _, ok := d.words.Load(id); !ok {
+			return id
+		}
+	}
+}
+
+// lookup appends the IDs of the topic's words to ids, with noWord in place of
+// unseen ones, and returns the extended slice. Lookups don't intern their
+// topics, so the dictionary only grows with the words which are subscribed
+// to.
+func (d *wordDictionary) lookup(topic string, ids []uint32) []uint32 {
+	m := d.ids.Load()
+	words := newTokenizer(topic)
+	for word, ok := words.next(); ok; word, ok = words.next() {
+		ids = append(ids, m.get(d.hash(word), word).wordID())
+	}
+	return ids
+}
+
+// lookupWords is like lookup but takes the topic's words rather than the
+// topic, sparing the words a join and split. The words are unescaped, so they
+// may contain the delimiter.
+func (d *wordDictionary) lookupWords(words []string, ids []uint32) []uint32 {
+	if len(words) == 0 {
+		// Like the empty topic, no words make a single empty word.
+		words = emptyWords
+	}
+	m := d.ids.Load()
+	for _, word := range words {
+		word = EscapeWord(word)
+		ids = append(ids, m.get(d.hash(word), word).wordID())
+	}
+	return ids
+}
+
+// wordID returns the ID of the word, or noWord if it is nil because the word
+// is unseen.
+func (w *internedWord) wordID() uint32 {
+	if w == nil {
+		return noWord
+	}
+	return w.id
+}
+
+// join returns the topic made of the words with the given IDs. False is
+// returned if any of the words has been forgotten, in which case no
+// Subscription indexes the topic any longer.
+func (d *wordDictionary) join(ids []uint32) (string, bool) {
+	words := make([]string, len(ids))
+	for i, id := range ids {
+		w, ok := d.words.Load(id)
+		if !ok {
+			return "", false
+		}
+		words[i] = w.(*internedWord).word
+	}
+	return strings.Join(words, delimiter), true
+}
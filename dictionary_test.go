@@ -0,0 +1,286 @@
+package matching
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWordDictionary(t *testing.T) {
+	assert := assert.New(t)
+	d := newWordDictionary()
+
+	assert.Equal([]uint32{wildcardID}, d.lookup(wildcard, nil))
+	assert.Equal([]uint32{noWord, wildcardID}, d.lookup("forex.*", nil))
+
+	ids := d.intern("forex.eur.", nil)
+	assert.Len(ids, 3)
+	assert.NotContains(ids, noWord)
+	assert.NotEqual(ids[0], ids[1])
+	assert.Equal(ids, d.intern("forex.eur.", nil))
+	assert.Equal(ids, d.lookup("forex.eur.", nil))
+	topic, ok := d.join(ids)
+	assert.True(ok)
+	assert.Equal("forex.eur.", topic)
+
+	// The empty word is a word like any other.
+	assert.Equal([]uint32{ids[2]}, d.lookup(empty, nil))
+	assert.Equal([]uint32{ids[0], noWord}, d.lookup("forex.usd", nil))
+}
+
+func TestWordDictionaryConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		d   = newWordDictionary()
+		ids = make([][]uint32, 8)
+		wg  sync.WaitGroup
+	)
+
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ids[i] = append(ids[i], d.intern(strconv.Itoa(j), nil)...)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range ids {
+		assert.Equal(ids[0], ids[i])
+	}
+	seen := make(map[uint32]struct{})
+	for j, id := range ids[0] {
+		seen[id] = struct{}{}
+		word, ok := d.join([]uint32{id})
+		assert.True(ok)
+		assert.Equal(strconv.Itoa(j), word)
+	}
+	assert.Len(seen, 1000)
+}
+
+// Ensures lookups racing words being interned and forgotten see either no
+// ID or the word's own.
+func TestWordDictionaryConcurrentRelease(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		d    = newWordDictionary()
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	base := d.intern("base", nil)[0]
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ids := d.lookup("base.churn", nil)
+			assert.Equal(base, ids[0])
+			if ids[1] != noWord {
+				// The word may be forgotten in between.
+				if word, ok := d.join(ids[1:]); ok {
+					assert.Equal("churn", word)
+				}
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		d.intern("churn", nil)
+		d.release("churn")
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(2, d.size)
+}
+
+// Ensures a word interned and released by many goroutines at once is never
+// forgotten while a reference to it is held, and is forgotten once none are.
+func TestWordDictionaryConcurrentChurn(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		d  = newWordDictionary()
+		wg sync.WaitGroup
+	)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id := d.intern("churn", nil)[0]
+				assert.Equal([]uint32{id}, d.lookup("churn", nil))
+				word, ok := d.join([]uint32{id})
+				assert.True(ok)
+				assert.Equal("churn", word)
+				d.release("churn")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal([]uint32{noWord}, d.lookup("churn", nil))
+	assert.Equal(1, d.size)
+}
+
+// Ensures words are forgotten once every topic interning them is released.
+func TestWordDictionaryRelease(t *testing.T) {
+	assert := assert.New(t)
+	d := newWordDictionary()
+
+	ids := d.intern("forex.eur", nil)
+	assert.Equal(ids[:1], d.intern("forex.usd.*", nil)[:1])
+	d.release("forex.eur")
+	assert.Equal([]uint32{ids[0], noWord}, d.lookup("forex.eur", nil))
+	_, ok := d.join(ids)
+	assert.False(ok)
+
+	d.release("forex.usd.*")
+	assert.Equal([]uint32{noWord, noWord, wildcardID}, d.lookup("forex.usd.*", nil))
+	assert.Equal(1, d.size)
+
+	// Forgotten IDs aren't reused straight away.
+	assert.NotContains(ids, d.intern("forex", nil)[0])
+}
+
+// Ensures the dictionary refuses to assign an ID once every ID is in use and
+// reuses IDs once they are free again.
+func TestWordDictionaryExhausted(t *testing.T) {
+	assert := assert.New(t)
+	d := newWordDictionary()
+	d.limit = 4
+
+	assert.Equal([]uint32{2, 3, 4}, d.intern("a.b.c", nil))
+	assert.Panics(func() { d.intern("d", nil) })
+	assert.Equal([]uint32{2}, d.intern("a", nil))
+
+	d.release("a.b.c")
+	assert.Equal([]uint32{3}, d.intern("d", nil))
+	assert.Equal([]uint32{4, 3}, d.intern("e.d", nil))
+	assert.Panics(func() { d.intern("f", nil) })
+}
+
+func TestMatchersUnseenWords(t *testing.T) {
+	matchers := map[string]Matcher{
+		"trie":              NewTrieMatcher(),
+		"rcu":               NewRCUTrieMatcher(),
+		"locking":           NewLockingTrieMatcher(),
+		"cstrie":            NewCSTrieMatcher(),
+		"optimized":         NewOptimizedInvertedBitmapMatcher(3),
+		"optimized64":       NewOptimizedInvertedBitmapMatcher64(3),
+		"learning inverted": NewLearningInvertedBitmapMatcher(nil),
+	}
+	for name, m := range matchers {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var (
+				s0 = 0
+				s1 = 1
+			)
+
+			_, err := m.Subscribe("unseen-a.*", s0)
+			assert.NoError(err)
+			_, err = m.Subscribe("unseen-a..c", s1)
+			assert.NoError(err)
+
+			// Words which were never subscribed to only match wildcards.
+			assertEqual(assert, []Subscriber{s0}, m.Lookup("unseen-a.unseen-b"))
+			assertEqual(assert, []Subscriber{}, m.Lookup("unseen-b.unseen-a"))
+			assertEqual(assert, []Subscriber{s0}, m.Lookup("unseen-a."))
+			assertEqual(assert, []Subscriber{s1}, m.Lookup("unseen-a..c"))
+			assertEqual(assert, []Subscriber{}, m.Lookup("unseen-a.unseen-b.c"))
+
+			m.UnsubscribeMatching("unseen-a.unseen-b")
+			assertEqual(assert, []Subscriber{s0}, m.Lookup("unseen-a.x"))
+			m.UnsubscribePrefix("unseen-a")
+			assertEqual(assert, []Subscriber{}, m.Lookup("unseen-a.x"))
+			assertEqual(assert, []Subscriber{}, m.Lookup("unseen-a..c"))
+		})
+	}
+}
+
+// Ensures matchers release the words of the Subscriptions they remove.
+func TestMatchersForgetWords(t *testing.T) {
+	matchers := map[string]Matcher{
+		"trie":        NewTrieMatcher(),
+		"rcu":         NewRCUTrieMatcher(),
+		"locking":     NewLockingTrieMatcher(),
+		"cstrie":      NewCSTrieMatcher(),
+		"optimized":   NewOptimizedInvertedBitmapMatcher(3),
+		"optimized64": NewOptimizedInvertedBitmapMatcher64(3),
+	}
+	for name, m := range matchers {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			d := matcherDictionary(m)
+
+			var subs []*Subscription
+			for i := 0; i < 100; i++ {
+				sub, err := m.Subscribe("churn."+strconv.Itoa(i)+".x", i)
+				assert.NoError(err)
+				subs = append(subs, sub)
+				_, err = m.Subscribe("churn.*", i%3)
+				assert.NoError(err)
+			}
+			for _, sub := range subs[:25] {
+				m.Unsubscribe(sub)
+			}
+			m.UnsubscribeMatching("churn.*.x")
+			m.UnsubscribeAll(0)
+			m.UnsubscribePrefix("churn")
+			assertEqual(assert, []Subscriber{}, m.Lookup("churn.1.x"))
+
+			// Only the wildcard is left.
+			d.mu.Lock()
+			assert.Equal(1, d.size)
+			d.mu.Unlock()
+		})
+	}
+}
+
+func TestInvertedBitmapMatcherForgetsTopics(t *testing.T) {
+	assert := assert.New(t)
+	m := NewLearningInvertedBitmapMatcher([]string{"forex.eur"})
+	d := matcherDictionary(m)
+	_, err := m.Subscribe("forex.*", 0)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{0}, m.Lookup("forex.usd"))
+
+	m.RemoveTopic("forex.eur")
+	m.RemoveTopic("forex.eur")
+	m.RemoveTopic("forex.usd")
+	d.mu.Lock()
+	assert.Equal(1, d.size)
+	d.mu.Unlock()
+}
+
+// matcherDictionary returns the word dictionary of the matcher.
+func matcherDictionary(m Matcher) *wordDictionary {
+	switch m := m.(type) {
+	case *trieMatcher:
+		return m.dictionary
+	case *rcuTrieMatcher:
+		return m.dictionary
+	case *lockingTrieMatcher:
+		return m.dictionary
+	case *csTrieMatcher:
+		return m.dictionary
+	case *invertedBitmapMatcher[uint32, *roaring.Bitmap]:
+		return m.dictionary
+	case *invertedBitmapMatcher[uint64, *roaring64.Bitmap]:
+		return m.dictionary
+	case *optimizedInvertedBitmapMatcher[uint32, *roaring.Bitmap]:
+		return m.dictionary
+	case *optimizedInvertedBitmapMatcher[uint64, *roaring64.Bitmap]:
+		return m.dictionary
+	}
+	panic("matching: matcher has no dictionary")
+}
@@ -0,0 +1,306 @@
+package matching
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// defaultExpiryBatchSize is the number of Subscriptions removed per batch if
+// ExpiryConfig.BatchSize is not set.
+const defaultExpiryBatchSize = 1024
+
+// Clock provides the current time. It allows time to be controlled in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ExpiryConfig configures an ExpiringMatcher.
+type ExpiryConfig struct {
+	// Clock is used to determine when leases lapse. Defaults to the system
+	// clock.
+	Clock Clock
+
+	// Interval is how often the background reaper runs. If zero, no reaper is
+	// started and Expire must be called explicitly.
+	Interval time.Duration
+
+	// BatchSize is the maximum number of Subscriptions removed while the
+	// lock is held. Defaults to 1024.
+	BatchSize int
+
+	// OnExpire, if set, is called with each batch of expired Subscriptions
+	// after they have been removed.
+	OnExpire func(expired []*Subscription)
+}
+
+// lease is the deadline of a Subscription created with a TTL.
+type lease struct {
+	sub      Subscription
+	deadline time.Time
+	index    int
+}
+
+// leaseHeap is a min-heap of leases ordered by deadline.
+type leaseHeap []*lease
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *leaseHeap) Push(x interface{}) {
+	l := x.(*lease)
+	l.index = len(*h)
+	*h = append(*h, l)
+}
+
+func (h *leaseHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	l := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return l
+}
+
+// ExpiringMatcher wraps a Matcher and allows Subscriptions to be created with
+// a time-to-live. Subscriptions whose lease lapses without being renewed are
+// removed by Expire, which is called periodically by a background reaper if
+// one is configured. Writes made through the ExpiringMatcher are serialized
+// so that expiry never races with a renewal or resubscription. Lookups go
+// straight to the wrapped Matcher.
+type ExpiringMatcher struct {
+	Matcher
+	clock     Clock
+	batchSize int
+	onExpire  func([]*Subscription)
+	leases    map[Subscription]*lease
+	deadlines leaseHeap
+	mu        sync.Mutex
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+// NewExpiringMatcher returns an ExpiringMatcher wrapping the given Matcher.
+// If config.Interval is set, a background reaper is started which must be
+// stopped with Stop.
+func NewExpiringMatcher(m Matcher, config ExpiryConfig) *ExpiringMatcher {
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultExpiryBatchSize
+	}
+	e := &ExpiringMatcher{
+		Matcher:   m,
+		clock:     config.Clock,
+		batchSize: config.BatchSize,
+		onExpire:  config.OnExpire,
+		leases:    make(map[Subscription]*lease),
+	}
+	if config.Interval > 0 {
+		e.stop = make(chan struct{})
+		e.done = make(chan struct{})
+		go e.reap(config.Interval)
+	}
+	return e
+}
+
+// Subscribe adds the Subscriber to the topic and returns a Subscription which
+// does not expire. If the wrapped Matcher already holds an identical
+// Subscription with a lease, the lease is cancelled.
+func (e *ExpiringMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s, err := e.Matcher.Subscribe(topic, sub)
+	if err != nil {
+		return nil, err
+	}
+	e.cancel(*s)
+	return s, nil
+}
+
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (e *ExpiringMatcher) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return e.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (e *ExpiringMatcher) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return e.Subscribe(joinFilter(words), sub)
+}
+
+// SubscribeWithTTL adds the Subscriber to the topic and returns a
+// Subscription which is removed once the TTL elapses unless it is renewed.
+// If the wrapped Matcher already holds an identical Subscription, it is
+// returned with the lease instead, so a permanent Subscription becomes one
+// which expires. Subscribe makes it permanent again.
+func (e *ExpiringMatcher) SubscribeWithTTL(topic string, sub Subscriber, ttl time.Duration) (*Subscription, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s, err := e.Matcher.Subscribe(topic, sub)
+	if err != nil {
+		return nil, err
+	}
+	deadline := e.clock.Now().Add(ttl)
+	if l, ok := e.leases[*s]; ok {
+		l.deadline = deadline
+		heap.Fix(&e.deadlines, l.index)
+	} else {
+		l = &lease{sub: *s, deadline: deadline}
+		e.leases[*s] = l
+		heap.Push(&e.deadlines, l)
+	}
+	return s, nil
+}
+
+// Renew extends the lease of the Subscription so that it expires after the
+// given TTL. False is returned if the Subscription has no lease, either
+// because it has already expired or was never created with a TTL.
+func (e *ExpiringMatcher) Renew(sub *Subscription, ttl time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l, ok := e.leases[*sub]
+	if !ok {
+		return false
+	}
+	l.deadline = e.clock.Now().Add(ttl)
+	heap.Fix(&e.deadlines, l.index)
+	return true
+}
+
+// Unsubscribe removes the Subscription and its lease.
+func (e *ExpiringMatcher) Unsubscribe(sub *Subscription) {
+	e.mu.Lock()
+	e.cancel(*sub)
+	e.Matcher.Unsubscribe(sub)
+	e.mu.Unlock()
+}
+
+// UnsubscribeAll removes all Subscriptions for the Subscriber along with
+// their leases.
+func (e *ExpiringMatcher) UnsubscribeAll(sub Subscriber) {
+	e.mu.Lock()
+	e.cancelMatching(func(s Subscription) bool { return s.subscriber == sub })
+	e.Matcher.UnsubscribeAll(sub)
+	e.mu.Unlock()
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern along with their leases.
+func (e *ExpiringMatcher) UnsubscribeMatching(pattern string) {
+	e.mu.Lock()
+	e.cancelMatching(func(s Subscription) bool {
+		return covers(pattern, s.topic)
+	})
+	e.Matcher.UnsubscribeMatching(pattern)
+	e.mu.Unlock()
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix along with their leases.
+func (e *ExpiringMatcher) UnsubscribePrefix(prefix string) {
+	e.mu.Lock()
+	e.cancelMatching(func(s Subscription) bool {
+		return coversPrefix(prefix, s.topic)
+	})
+	e.Matcher.UnsubscribePrefix(prefix)
+	e.mu.Unlock()
+}
+
+// Expire removes every Subscription whose lease has lapsed and returns the
+// number removed. Subscriptions are removed in batches, releasing the lock
+// between them, and OnExpire is called once per batch.
+func (e *ExpiringMatcher) Expire() int {
+	total := 0
+	for {
+		expired := e.expireBatch()
+		if len(expired) == 0 {
+			return total
+		}
+		total += len(expired)
+		if e.onExpire != nil {
+			e.onExpire(expired)
+		}
+	}
+}
+
+// expireBatch removes up to batchSize lapsed Subscriptions and returns them.
+func (e *ExpiringMatcher) expireBatch() []*Subscription {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var (
+		now     = e.clock.Now()
+		expired []*Subscription
+	)
+	for len(e.deadlines) > 0 && len(expired) < e.batchSize {
+		if e.deadlines[0].deadline.After(now) {
+			break
+		}
+		l := heap.Pop(&e.deadlines).(*lease)
+		delete(e.leases, l.sub)
+		sub := l.sub
+		e.Matcher.Unsubscribe(&sub)
+		expired = append(expired, &sub)
+	}
+	return expired
+}
+
+// Stop stops the background reaper, if one is running, and waits for it to
+// exit. It is safe to call more than once, including concurrently.
+func (e *ExpiringMatcher) Stop() {
+	if e.stop == nil {
+		return
+	}
+	e.stopOnce.Do(func() { close(e.stop) })
+	<-e.done
+}
+
+func (e *ExpiringMatcher) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+		close(e.done)
+	}()
+	for {
+		select {
+		case <-ticker.C:
+			e.Expire()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// cancel removes the lease for the Subscription, if any. The caller must hold
+// the lock.
+func (e *ExpiringMatcher) cancel(sub Subscription) {
+	if l, ok := e.leases[sub]; ok {
+		heap.Remove(&e.deadlines, l.index)
+		delete(e.leases, sub)
+	}
+}
+
+// cancelMatching removes the leases for every Subscription satisfying the
+// predicate. The caller must hold the lock.
+func (e *ExpiringMatcher) cancelMatching(match func(Subscription) bool) {
+	for sub, _ := range e.leases {
+		if match(sub) {
+			e.cancel(sub)
+		}
+	}
+}
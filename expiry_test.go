@@ -0,0 +1,166 @@
+package matching
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func TestExpiringMatcher(t *testing.T) {
+	testExpiringMatcher(t, NewTrieMatcher())
+	testExpiringMatcher(t, NewCSTrieMatcher())
+}
+
+func testExpiringMatcher(t *testing.T, m Matcher) {
+	assert := assert.New(t)
+	var (
+		clock   = &fakeClock{now: time.Unix(0, 0)}
+		batches [][]*Subscription
+		e       = NewExpiringMatcher(m, ExpiryConfig{
+			Clock:     clock,
+			BatchSize: 2,
+			OnExpire: func(expired []*Subscription) {
+				batches = append(batches, expired)
+			},
+		})
+		s0 = 0
+		s1 = 1
+		s2 = 2
+	)
+
+	sub0, err := e.SubscribeWithTTL("device.1", s0, time.Minute)
+	assert.NoError(err)
+	_, err = e.SubscribeWithTTL("device.2", s1, time.Minute)
+	assert.NoError(err)
+	_, err = e.SubscribeWithTTL("device.*", s2, time.Minute)
+	assert.NoError(err)
+	_, err = e.Subscribe("device.3", s2)
+	assert.NoError(err)
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(0, e.Expire())
+	assert.True(e.Renew(sub0, time.Minute))
+
+	clock.Advance(45 * time.Second)
+	assert.Equal(2, e.Expire())
+	assert.Len(batches, 1)
+	assertEqual(assert, []Subscriber{s0}, e.Lookup("device.1"))
+	assertEqual(assert, []Subscriber{}, e.Lookup("device.2"))
+	assertEqual(assert, []Subscriber{s2}, e.Lookup("device.3"))
+
+	clock.Advance(time.Minute)
+	assert.Equal(1, e.Expire())
+	assert.False(e.Renew(sub0, time.Minute))
+	assertEqual(assert, []Subscriber{}, e.Lookup("device.1"))
+	assertTopics(assert, []string{"device.3"}, e.Topics(s2))
+
+	// Resubscribing without a TTL makes the Subscription permanent.
+	_, err = e.SubscribeWithTTL("device.4", s0, time.Minute)
+	assert.NoError(err)
+	_, err = e.Subscribe("device.4", s0)
+	assert.NoError(err)
+	clock.Advance(time.Hour)
+	assert.Equal(0, e.Expire())
+	assertEqual(assert, []Subscriber{s0}, e.Lookup("device.4"))
+
+	// Subscribing with a TTL gives the permanent Subscription a lease.
+	_, err = e.SubscribeWithTTL("device.4", s0, time.Minute)
+	assert.NoError(err)
+	clock.Advance(time.Hour)
+	assert.Equal(1, e.Expire())
+	assertEqual(assert, []Subscriber{}, e.Lookup("device.4"))
+}
+
+func TestExpiringMatcherBytes(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		clock = &fakeClock{now: time.Unix(0, 0)}
+		e     = NewExpiringMatcher(NewTrieMatcher(), ExpiryConfig{Clock: clock})
+		s0    = 0
+	)
+	testBytes(assert, e)
+
+	// Byte slice subscriptions are permanent, like Subscribe's.
+	_, err := e.SubscribeWithTTL("device.1", s0, time.Minute)
+	assert.NoError(err)
+	_, err = e.SubscribeBytes([]byte("device.1"), s0)
+	assert.NoError(err)
+	clock.Advance(time.Hour)
+	assert.Equal(0, e.Expire())
+	assertEqual(assert, []Subscriber{s0}, e.LookupBytes([]byte("device.1")))
+}
+
+func TestExpiringMatcherWords(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		clock = &fakeClock{now: time.Unix(0, 0)}
+		e     = NewExpiringMatcher(NewTrieMatcher(), ExpiryConfig{Clock: clock})
+		s0    = 0
+	)
+	testWords(assert, e)
+
+	// Word subscriptions are permanent, like Subscribe's.
+	_, err := e.SubscribeWithTTL(`device.1\.2`, s0, time.Minute)
+	assert.NoError(err)
+	_, err = e.SubscribeWords([]string{"device", "1.2"}, s0)
+	assert.NoError(err)
+	clock.Advance(time.Hour)
+	assert.Equal(0, e.Expire())
+	assertEqual(assert, []Subscriber{s0}, e.LookupWords([]string{"device", "1.2"}))
+}
+
+func TestExpiringMatcherReaper(t *testing.T) {
+	assert := assert.New(t)
+	expired := make(chan []*Subscription, 1)
+	e := NewExpiringMatcher(NewTrieMatcher(), ExpiryConfig{
+		Interval: time.Millisecond,
+		OnExpire: func(subs []*Subscription) {
+			expired <- subs
+		},
+	})
+	defer e.Stop()
+
+	_, err := e.SubscribeWithTTL("device.1", 0, time.Millisecond)
+	assert.NoError(err)
+
+	select {
+	case subs := <-expired:
+		assert.Len(subs, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscription did not expire")
+	}
+	assertEqual(assert, []Subscriber{}, e.Lookup("device.1"))
+}
+
+func TestExpiringMatcherStop(t *testing.T) {
+	var (
+		e  = NewExpiringMatcher(NewTrieMatcher(), ExpiryConfig{Interval: time.Millisecond})
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Stop()
+		}()
+	}
+	wg.Wait()
+	e.Stop()
+
+	// Without a reaper, Stop does nothing.
+	NewExpiringMatcher(NewTrieMatcher(), ExpiryConfig{}).Stop()
+}
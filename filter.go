@@ -0,0 +1,120 @@
+package matching
+
+import "strings"
+
+// coversWord indicates if the pattern word matches every topic word the
+// filter word does.
+func coversWord(pattern, word string) bool {
+	return pattern == wildcard || pattern == word
+}
+
+// hasWildcard indicates if any word of the filter is the wildcard.
+func hasWildcard(filter string) bool {
+	words := newTokenizer(filter)
+	for word, ok := words.next(); ok; word, ok = words.next() {
+		if word == wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// coversPrefix indicates if the leading words of the filter are covered, word
+// for word, by the pattern.
+func coversPrefix(pattern, filter string) bool {
+	var (
+		p = newTokenizer(pattern)
+		f = newTokenizer(filter)
+	)
+	for {
+		patternWord, ok := p.next()
+		if !ok {
+			return true
+		}
+		filterWord, ok := f.next()
+		if !ok || !coversWord(patternWord, filterWord) {
+			return false
+		}
+	}
+}
+
+// covers indicates if every topic matched by the filter is also matched by
+// the pattern.
+func covers(pattern, filter string) bool {
+	var (
+		p = newTokenizer(pattern)
+		f = newTokenizer(filter)
+	)
+	for {
+		patternWord, pok := p.next()
+		filterWord, fok := f.next()
+		if !pok || !fok {
+			// Only a filter with as many words as the pattern is covered.
+			return pok == fok
+		}
+		if !coversWord(patternWord, filterWord) {
+			return false
+		}
+	}
+}
+
+// intersectWord returns the word matching exactly the topic words matched by
+// both filter words. False is returned if no topic word is matched by both.
+func intersectWord(a, b string) (string, bool) {
+	switch {
+	case a == wildcard:
+		return b, true
+	case b == wildcard, a == b:
+		return a, true
+	default:
+		return empty, false
+	}
+}
+
+// Subsumes indicates if filter a contains filter b, that is, if every topic
+// matched by b is also matched by a.
+func Subsumes(a, b string) bool {
+	return covers(a, b)
+}
+
+// Overlaps indicates if there is at least one topic matched by both filters.
+func Overlaps(a, b string) bool {
+	return intersect(a, b, nil)
+}
+
+// Intersection returns the filter which matches exactly the topics matched by
+// both filters. False is returned if the filters have no topic in common.
+func Intersection(a, b string) (string, bool) {
+	var intersection strings.Builder
+	intersection.Grow(len(a))
+	if !intersect(a, b, &intersection) {
+		return empty, false
+	}
+	return intersection.String(), true
+}
+
+// intersect indicates if the filters have a topic in common, writing the
+// filter matching exactly their common topics to w unless it's nil.
+func intersect(a, b string, w *strings.Builder) bool {
+	var (
+		aWords = newTokenizer(a)
+		bWords = newTokenizer(b)
+	)
+	for i := 0; ; i++ {
+		aWord, aok := aWords.next()
+		bWord, bok := bWords.next()
+		if !aok || !bok {
+			return aok == bok
+		}
+		word, ok := intersectWord(aWord, bWord)
+		if !ok {
+			return false
+		}
+		if w != nil {
+			if i > 0 {
+				w.WriteString(delimiter)
+			}
+			w.WriteString(word)
+		}
+	}
+}
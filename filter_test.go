@@ -0,0 +1,117 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// enumerate returns every topic of 1 to maxLen words drawn from words.
+func enumerate(words []string, maxLen int) []string {
+	var (
+		topics []string
+		level  = []string{empty}
+	)
+	for i := 0; i < maxLen; i++ {
+		next := make([]string, 0, len(level)*len(words))
+		for _, prefix := range level {
+			for _, word := range words {
+				if i == 0 {
+					next = append(next, word)
+				} else {
+					next = append(next, prefix+delimiter+word)
+				}
+			}
+		}
+		topics = append(topics, next...)
+		level = next
+	}
+	return topics
+}
+
+func TestFilterAlgebra(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		filters = enumerate([]string{"a", "b", wildcard}, 3)
+
+		// "c" never appears in a filter so that wildcards match words which
+		// no literal does.
+		topics = enumerate([]string{"a", "b", "c"}, 3)
+	)
+
+	matched := make(map[string]map[string]bool, len(filters))
+	for _, filter := range filters {
+		matched[filter] = make(map[string]bool)
+		for _, topic := range topics {
+			matched[filter][topic] = topicMatches(filter, topic)
+		}
+	}
+
+	for _, a := range filters {
+		for _, b := range filters {
+			var (
+				subsumes = true
+				overlaps = false
+			)
+			for _, topic := range topics {
+				if matched[b][topic] && !matched[a][topic] {
+					subsumes = false
+				}
+				if matched[a][topic] && matched[b][topic] {
+					overlaps = true
+				}
+			}
+			assert.Equal(subsumes, Subsumes(a, b), "Subsumes(%q, %q)", a, b)
+			assert.Equal(overlaps, Overlaps(a, b), "Overlaps(%q, %q)", a, b)
+
+			intersection, ok := Intersection(a, b)
+			assert.Equal(overlaps, ok, "Intersection(%q, %q)", a, b)
+			if !ok {
+				continue
+			}
+			for _, topic := range topics {
+				assert.Equal(matched[a][topic] && matched[b][topic],
+					topicMatches(intersection, topic),
+					"Intersection(%q, %q) = %q on %q", a, b, intersection, topic)
+			}
+		}
+	}
+}
+
+func TestIntersection(t *testing.T) {
+	assert := assert.New(t)
+
+	intersection, ok := Intersection("orders.*.eu", "orders.new.*")
+	assert.True(ok)
+	assert.Equal("orders.new.eu", intersection)
+
+	_, ok = Intersection("orders.*.eu", "orders.*.us")
+	assert.False(ok)
+
+	_, ok = Intersection("orders.*", "orders.*.eu")
+	assert.False(ok)
+
+	assert.True(Subsumes("orders.*.*", "orders.*.eu"))
+	assert.False(Subsumes("orders.*.eu", "orders.*.*"))
+	assert.True(Subsumes("a.*", "a.b"))
+}
+
+func TestFilterEscapes(t *testing.T) {
+	assert := assert.New(t)
+	literal := JoinWords("files", wildcard)
+
+	// A literal "*" word is matched only by itself or a wildcard.
+	assert.True(Subsumes("files.*", literal))
+	assert.False(Subsumes(literal, "files.*"))
+	assert.False(Overlaps(literal, "files.x"))
+	intersection, ok := Intersection("files.*", literal)
+	assert.True(ok)
+	assert.Equal(literal, intersection)
+
+	// Escaped delimiters don't split words, and redundant escapes don't
+	// change them.
+	assert.True(Subsumes(`files.a*b`, `files.a\*b`))
+	assert.False(Subsumes(`files.report\.pdf`, `files.report\.\pdf`))
+	assert.False(Overlaps(`files.report\.pdf`, "files.report.pdf"))
+	assert.True(Overlaps(`files.report\.pdf`, "*.*"))
+}
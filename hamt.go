@@ -0,0 +1,204 @@
+package matching
+
+import "math/bits"
+
+const (
+	// hamtBits is the number of hash bits consumed at each level of a hamt.
+	hamtBits = 5
+
+	// hamtMultiplier scrambles word IDs so that sequential IDs spread across
+	// the slots of a level. Since it is odd, the hash is a bijection, so two
+	// words never share every hash bit.
+	hamtMultiplier = 0x9e3779b1
+)
+
+// hamt is a persistent hash array mapped trie from word IDs to values of type
+// V, such as the branches of a C-node or the children of an rcuNode. It is
+// never modified in place. Instead, with and without return a new hamt which
+// shares every node off the changed path with the old one, so a write copies
+// O(log n) small nodes rather than every value. The zero value is empty.
+type hamt[V any] struct {
+	root *hamtNode[V]
+	size int
+}
+
+// hamtNode is an internal node of a hamt. Each set bit in the bitmap is a
+// slot holding either a value or a child node, and entries holds the
+// occupied slots in order.
+type hamtNode[V any] struct {
+	bitmap  uint32
+	entries []hamtEntry[V]
+}
+
+// hamtEntry is a slot of a hamtNode. It holds a child node if child is set
+// and a word and its value otherwise.
+type hamtEntry[V any] struct {
+	word  uint32
+	value V
+	child *hamtNode[V]
+}
+
+func hashWord(word uint32) uint32 {
+	return word * hamtMultiplier
+}
+
+// slot returns the bitmap bit and entry index for the hash at the given
+// shift.
+func (n *hamtNode[V]) slot(hash uint32, shift uint) (uint32, int) {
+	bit := uint32(1) << ((hash >> shift) & (1<<hamtBits - 1))
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+// clone returns a copy of the node with its own entries.
+func (n *hamtNode[V]) clone() *hamtNode[V] {
+	entries := make([]hamtEntry[V], len(n.entries))
+	copy(entries, n.entries)
+	return &hamtNode[V]{bitmap: n.bitmap, entries: entries}
+}
+
+// len returns the number of words in the hamt.
+func (h hamt[V]) len() int {
+	return h.size
+}
+
+// get returns the value for the word, or the zero value if there is none.
+func (h hamt[V]) get(word uint32) V {
+	var (
+		n     = h.root
+		hash  = hashWord(word)
+		shift uint
+		none  V
+	)
+	for n != nil {
+		bit, idx := n.slot(hash, shift)
+		if n.bitmap&bit == 0 {
+			return none
+		}
+		e := n.entries[idx]
+		if e.child == nil {
+			if e.word == word {
+				return e.value
+			}
+			return none
+		}
+		n = e.child
+		shift += hamtBits
+	}
+	return none
+}
+
+// with returns a copy of the hamt in which the word maps to the value.
+func (h hamt[V]) with(word uint32, value V) hamt[V] {
+	root := h.root
+	if root == nil {
+		root = &hamtNode[V]{}
+	}
+	root, added := root.insert(hashWord(word), 0, word, value)
+	if added {
+		h.size++
+	}
+	return hamt[V]{root: root, size: h.size}
+}
+
+// insert returns a copy of the node with the word mapped to the value and
+// whether the word was added rather than replaced.
+func (n *hamtNode[V]) insert(hash uint32, shift uint, word uint32, value V) (*hamtNode[V], bool) {
+	bit, idx := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		entries := make([]hamtEntry[V], len(n.entries)+1)
+		copy(entries, n.entries[:idx])
+		entries[idx] = hamtEntry[V]{word: word, value: value}
+		copy(entries[idx+1:], n.entries[idx:])
+		return &hamtNode[V]{bitmap: n.bitmap | bit, entries: entries}, true
+	}
+
+	var (
+		c     = n.clone()
+		e     = n.entries[idx]
+		added bool
+	)
+	switch {
+	case e.child != nil:
+		c.entries[idx].child, added = e.child.insert(hash, shift+hamtBits, word, value)
+	case e.word == word:
+		c.entries[idx].value = value
+	default:
+		// Two words share the slot, so push both down a level.
+		child, _ := (&hamtNode[V]{}).insert(hashWord(e.word), shift+hamtBits, e.word, e.value)
+		child, added = child.insert(hash, shift+hamtBits, word, value)
+		c.entries[idx] = hamtEntry[V]{child: child}
+	}
+	return c, added
+}
+
+// without returns a copy of the hamt with the word removed.
+func (h hamt[V]) without(word uint32) hamt[V] {
+	if h.root == nil {
+		return h
+	}
+	root, removed := h.root.remove(hashWord(word), 0, word)
+	if !removed {
+		return h
+	}
+	return hamt[V]{root: root, size: h.size - 1}
+}
+
+// remove returns a copy of the node without the word and whether the word was
+// present. A nil node is returned if the node is left empty.
+func (n *hamtNode[V]) remove(hash uint32, shift uint, word uint32) (*hamtNode[V], bool) {
+	bit, idx := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	e := n.entries[idx]
+	if e.child == nil {
+		if e.word != word {
+			return n, false
+		}
+		return n.removedEntry(bit, idx), true
+	}
+	child, removed := e.child.remove(hash, shift+hamtBits, word)
+	if !removed {
+		return n, false
+	}
+	if child == nil {
+		return n.removedEntry(bit, idx), true
+	}
+	c := n.clone()
+	if len(child.entries) == 1 && child.entries[0].child == nil {
+		// Pull a lone word back up so that paths stay as short as possible.
+		c.entries[idx] = child.entries[0]
+	} else {
+		c.entries[idx].child = child
+	}
+	return c, true
+}
+
+// removedEntry returns a copy of the node without the entry at the index and
+// its bitmap bit, or nil if it was the only entry.
+func (n *hamtNode[V]) removedEntry(bit uint32, idx int) *hamtNode[V] {
+	if len(n.entries) == 1 {
+		return nil
+	}
+	entries := make([]hamtEntry[V], 0, len(n.entries)-1)
+	entries = append(entries, n.entries[:idx]...)
+	entries = append(entries, n.entries[idx+1:]...)
+	return &hamtNode[V]{bitmap: n.bitmap &^ bit, entries: entries}
+}
+
+// each calls fn with every word in the hamt and its value.
+func (h hamt[V]) each(fn func(word uint32, value V)) {
+	if h.root != nil {
+		h.root.each(fn)
+	}
+}
+
+func (n *hamtNode[V]) each(fn func(word uint32, value V)) {
+	for _, e := range n.entries {
+		if e.child != nil {
+			e.child.each(fn)
+		} else {
+			fn(e.word, e.value)
+		}
+	}
+}
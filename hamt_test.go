@@ -0,0 +1,56 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHAMT(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		h        hamt[*branch]
+		expected = make(map[uint32]*branch)
+	)
+
+	for word := uint32(0); word < 5000; word++ {
+		br := &branch{}
+		h = h.with(word, br)
+		expected[word] = br
+	}
+	// Replacing a word doesn't change the size.
+	br := &branch{}
+	h = h.with(42, br)
+	expected[42] = br
+
+	before := h
+	for word := uint32(0); word < 5000; word += 3 {
+		h = h.without(word)
+		delete(expected, word)
+	}
+	h = h.without(5000)
+
+	assert.Equal(len(expected), h.len())
+	for word, br := range expected {
+		assert.True(br == h.get(word), word)
+	}
+	assert.Nil(h.get(0))
+	assert.Nil(h.get(5000))
+
+	seen := make(map[uint32]*branch)
+	h.each(func(word uint32, br *branch) {
+		seen[word] = br
+	})
+	assert.Equal(expected, seen)
+
+	// Earlier versions are unaffected by later writes.
+	assert.Equal(5000, before.len())
+	assert.NotNil(before.get(0))
+	assert.True(br == before.get(42))
+
+	for word := range expected {
+		h = h.without(word)
+	}
+	assert.Equal(0, h.len())
+	assert.Nil(h.root)
+}
@@ -0,0 +1,363 @@
+package matching
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// subscriptionIndex is a reverse index from Subscribers to the topics they
+// are subscribed to. It is not safe for concurrent use.
+type subscriptionIndex map[Subscriber]map[string]struct{}
+
+// add records that the Subscriber is subscribed to the topic. Returns false
+// if it already was.
+func (s subscriptionIndex) add(topic string, sub Subscriber) bool {
+	topics, ok := s[sub]
+	if !ok {
+		topics = make(map[string]struct{})
+		s[sub] = topics
+	}
+	if _, ok := topics[topic]; ok {
+		return false
+	}
+	topics[topic] = struct{}{}
+	return true
+}
+
+// remove records that the Subscriber is no longer subscribed to the topic.
+// Returns false if it wasn't subscribed.
+func (s subscriptionIndex) remove(topic string, sub Subscriber) bool {
+	topics, ok := s[sub]
+	if !ok {
+		return false
+	}
+	if _, ok := topics[topic]; !ok {
+		return false
+	}
+	delete(topics, topic)
+	if len(topics) == 0 {
+		delete(s, sub)
+	}
+	return true
+}
+
+// topics returns the topics the Subscriber is subscribed to.
+func (s subscriptionIndex) topics(sub Subscriber) []string {
+	topics := make([]string, 0, len(s[sub]))
+	for topic, _ := range s[sub] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// syncIndex is a reverse index from Subscribers to the topics they are
+// subscribed to which is safe for concurrent use without a lock. Each
+// Subscriber's topics are an immutable set which is replaced with a
+// compare-and-swap, so writers for different Subscribers never contend and
+// writers for the same Subscriber retry rather than block. The zero value is
+// empty.
+type syncIndex struct {
+	entries sync.Map // Subscriber -> *syncIndexEntry
+}
+
+// syncIndexEntry holds the topics of a Subscriber. Every update installs a
+// new set, even one which leaves the topics as they were, so that an update
+// which read the set before another one fails its compare-and-swap and reads
+// the set again. The set is nil once the entry has been emptied and is being
+// dropped from the index, after which the entry is never updated again.
+type syncIndexEntry struct {
+	topics atomic.Pointer[topicSet]
+}
+
+// topicSet is an immutable set of topics.
+type topicSet struct {
+	topics map[string]struct{}
+}
+
+// update brings the Subscriber's record of the topic in line with subscribed,
+// which reports whether the matcher holds the Subscription, and returns 1 if
+// the topic was added, -1 if it was removed and 0 otherwise. subscribed is
+// called after the set is read and before it is replaced, so an operation
+// which changes the Subscription and then calls update either is seen by
+// subscribed or fails the replacement of the set and is seen on the retry.
+// Whichever update replaces the set last therefore leaves it agreeing with
+// the matcher.
+func (x *syncIndex) update(topic string, sub Subscriber, subscribed func() bool) int {
+	for {
+		e := x.entry(sub)
+		old := e.topics.Load()
+		if old == nil {
+			x.entries.CompareAndDelete(sub, e)
+			continue
+		}
+		_, had := old.topics[topic]
+		has := subscribed()
+		next := &topicSet{topics: old.topics}
+		delta := 0
+		switch {
+		case has && !had:
+			next.topics = make(map[string]struct{}, len(old.topics)+1)
+			for t, _ := range old.topics {
+				next.topics[t] = struct{}{}
+			}
+			next.topics[topic] = struct{}{}
+			delta = 1
+		case had && !has:
+			next.topics = make(map[string]struct{}, len(old.topics)-1)
+			for t, _ := range old.topics {
+				if t != topic {
+					next.topics[t] = struct{}{}
+				}
+			}
+			delta = -1
+		}
+		if len(next.topics) == 0 {
+			if e.topics.CompareAndSwap(old, nil) {
+				x.entries.CompareAndDelete(sub, e)
+				return delta
+			}
+			continue
+		}
+		if e.topics.CompareAndSwap(old, next) {
+			return delta
+		}
+	}
+}
+
+// entry returns the Subscriber's entry, adding an empty one if it has none.
+func (x *syncIndex) entry(sub Subscriber) *syncIndexEntry {
+	if e, ok := x.entries.Load(sub); ok {
+		return e.(*syncIndexEntry)
+	}
+	e := &syncIndexEntry{}
+	e.topics.Store(&topicSet{})
+	actual, _ := x.entries.LoadOrStore(sub, e)
+	return actual.(*syncIndexEntry)
+}
+
+// topics returns the topics the Subscriber is subscribed to.
+func (x *syncIndex) topics(sub Subscriber) []string {
+	var set *topicSet
+	if e, ok := x.entries.Load(sub); ok {
+		set = e.(*syncIndexEntry).topics.Load()
+	}
+	if set == nil {
+		return []string{}
+	}
+	topics := make([]string, 0, len(set.topics))
+	for topic, _ := range set.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// positionIndex is a reverse index from Subscribers to the subscription
+// positions they hold in a bitmap matcher. It is not safe for concurrent use.
+type positionIndex[P position] map[Subscriber]map[P]struct{}
+
+// add records that the Subscriber holds the position.
+func (p positionIndex[P]) add(pos P, sub Subscriber) {
+	positions, ok := p[sub]
+	if !ok {
+		positions = make(map[P]struct{})
+		p[sub] = positions
+	}
+	positions[pos] = struct{}{}
+}
+
+// remove records that the Subscriber no longer holds the position.
+func (p positionIndex[P]) remove(pos P, sub Subscriber) {
+	positions, ok := p[sub]
+	if !ok {
+		return
+	}
+	delete(positions, pos)
+	if len(positions) == 0 {
+		delete(p, sub)
+	}
+}
+
+// removeAll removes the Subscriber from the index and returns the positions
+// it held.
+func (p positionIndex[P]) removeAll(sub Subscriber) []P {
+	positions := make([]P, 0, len(p[sub]))
+	for pos, _ := range p[sub] {
+		positions = append(positions, pos)
+	}
+	delete(p, sub)
+	return positions
+}
+
+// positionTopics returns the distinct topics for the given positions.
+func positionTopics[P position](positions map[P]struct{}, topics map[P]string) []string {
+	set := make(map[string]struct{}, len(positions))
+	for pos, _ := range positions {
+		set[topics[pos]] = struct{}{}
+	}
+	distinct := make([]string, 0, len(set))
+	for topic, _ := range set {
+		distinct = append(distinct, topic)
+	}
+	return distinct
+}
+
+// handleKey identifies a Subscription handle issued by a bitmap matcher by the
+// epoch it was issued in and the position it was assigned.
+type handleKey struct {
+	epoch uint32
+	id    uint64
+}
+
+// remapTable resolves Subscription handles to positions in a bitmap matcher
+// whose positions are renumbered by compaction. Each compaction starts a new
+// epoch. Handles issued in the current epoch refer to their position directly,
+// while older handles are looked up in the table. It is not safe for
+// concurrent use.
+type remapTable struct {
+	epoch     uint32
+	positions map[handleKey]uint64
+	handles   map[uint64]handleKey
+}
+
+func newRemapTable() *remapTable {
+	return &remapTable{
+		positions: make(map[handleKey]uint64),
+		handles:   make(map[uint64]handleKey),
+	}
+}
+
+// resolve returns the current position of the Subscription. False is returned
+// if the Subscription was issued in an earlier epoch and no longer exists.
+func (r *remapTable) resolve(sub *Subscription) (uint64, bool) {
+	if sub.epoch == r.epoch {
+		if _, ok := r.handles[sub.id]; ok {
+			// The position belongs to a Subscription from an earlier epoch.
+			return 0, false
+		}
+		return sub.id, true
+	}
+	pos, ok := r.positions[handleKey{epoch: sub.epoch, id: sub.id}]
+	return pos, ok
+}
+
+// release forgets the handle for the position, if any.
+func (r *remapTable) release(pos uint64) {
+	if key, ok := r.handles[pos]; ok {
+		delete(r.positions, key)
+		delete(r.handles, pos)
+	}
+}
+
+// renumber starts a new epoch in which the live positions are moved as given
+// by mapping.
+func (r *remapTable) renumber(mapping map[uint64]uint64) {
+	var (
+		positions = make(map[handleKey]uint64, len(mapping))
+		handles   = make(map[uint64]handleKey, len(mapping))
+	)
+	for oldPos, newPos := range mapping {
+		key, ok := r.handles[oldPos]
+		if !ok {
+			key = handleKey{epoch: r.epoch, id: oldPos}
+		}
+		positions[key] = newPos
+		handles[newPos] = key
+	}
+	r.positions = positions
+	r.handles = handles
+	r.epoch++
+}
+
+// densePositions returns a mapping from the given live positions to the
+// positions 0 through n-1, preserving their order.
+func densePositions(live []uint64) map[uint64]uint64 {
+	sort.Slice(live, func(i, j int) bool { return live[i] < live[j] })
+	mapping := make(map[uint64]uint64, len(live))
+	for newPos, oldPos := range live {
+		mapping[oldPos] = uint64(newPos)
+	}
+	return mapping
+}
+
+// position is a subscription position in a bitmap matcher. Matchers backed
+// by roaring.Bitmap use uint32 positions and those backed by roaring64.Bitmap
+// use uint64 positions.
+type position interface {
+	~uint32 | ~uint64
+}
+
+// positionBitmap is the subset of the roaring bitmap methods which the bitmap
+// matchers use, so that each matcher is written once for both bitmap types.
+// B is the bitmap type itself.
+type positionBitmap[P position, B any] interface {
+	Add(P)
+	Remove(P)
+	CheckedAdd(P) bool
+	CheckedRemove(P) bool
+	Contains(P) bool
+	IsEmpty() bool
+	GetCardinality() uint64
+	Or(B)
+	Clear()
+	RunOptimize()
+}
+
+// positionIterator iterates over the positions in a bitmap.
+type positionIterator[P position] interface {
+	HasNext() bool
+	Next() P
+}
+
+// bitmapOps holds the operations on bitmaps of type B which roaring provides
+// as functions rather than methods, as well as iteration, since the iterator
+// types differ between the 32- and 64-bit packages.
+type bitmapOps[P position, B positionBitmap[P, B]] struct {
+	new      func() B
+	and      func(x1, x2 B) B
+	fastAnd  func(bitmaps ...B) B
+	fastOr   func(bitmaps ...B) B
+	iterator func(bitmap B) positionIterator[P]
+}
+
+var (
+	// bitmaps32 are the operations on 32-bit roaring bitmaps.
+	bitmaps32 = &bitmapOps[uint32, *roaring.Bitmap]{
+		new:     roaring.New,
+		and:     roaring.And,
+		fastAnd: roaring.FastAnd,
+		fastOr:  roaring.FastOr,
+		iterator: func(bitmap *roaring.Bitmap) positionIterator[uint32] {
+			return bitmap.Iterator()
+		},
+	}
+
+	// bitmaps64 are the operations on 64-bit roaring bitmaps.
+	bitmaps64 = &bitmapOps[uint64, *roaring64.Bitmap]{
+		new:     roaring64.New,
+		and:     roaring64.And,
+		fastAnd: roaring64.FastAnd,
+		fastOr:  roaring64.FastOr,
+		iterator: func(bitmap *roaring64.Bitmap) positionIterator[uint64] {
+			return bitmap.Iterator()
+		},
+	}
+)
+
+// remap moves the positions in the bitmap as given by mapping, dropping
+// positions without a mapping. The bitmap is updated in place so that other
+// references to it remain valid.
+func (o *bitmapOps[P, B]) remap(bitmap B, mapping map[uint64]uint64) {
+	remapped := o.new()
+	for iter := o.iterator(bitmap); iter.HasNext(); {
+		if pos, ok := mapping[uint64(iter.Next())]; ok {
+			remapped.Add(P(pos))
+		}
+	}
+	bitmap.Clear()
+	bitmap.Or(remapped)
+	bitmap.RunOptimize()
+}
@@ -0,0 +1,60 @@
+package matching
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncIndex(t *testing.T) {
+	assert := assert.New(t)
+	var x syncIndex
+
+	assert.Equal(1, x.update("a", 0, func() bool { return true }))
+	assert.Equal(0, x.update("a", 0, func() bool { return true }))
+	assert.Equal(1, x.update("b", 0, func() bool { return true }))
+	assert.Equal(0, x.update("c", 0, func() bool { return false }))
+	assertTopics(assert, []string{"a", "b"}, x.topics(0))
+	assertTopics(assert, []string{}, x.topics(1))
+
+	assert.Equal(-1, x.update("a", 0, func() bool { return false }))
+	assert.Equal(-1, x.update("b", 0, func() bool { return false }))
+	assertTopics(assert, []string{}, x.topics(0))
+	_, ok := x.entries.Load(0)
+	assert.False(ok)
+}
+
+// Ensures racing updates leave the index agreeing with the state they read,
+// however they interleave with changes to it.
+func TestSyncIndexConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		x       syncIndex
+		present [4]atomic.Bool
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				k := (i + j) % len(present)
+				present[k].Store((i+j)%3 != 0)
+				x.update(strconv.Itoa(k), 0, present[k].Load)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	expected := []string{}
+	for k := range present {
+		if present[k].Load() {
+			expected = append(expected, strconv.Itoa(k))
+		}
+	}
+	assertTopics(assert, expected, x.topics(0))
+}
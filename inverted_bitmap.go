@@ -7,32 +7,186 @@ import (
 	"github.com/RoaringBitmap/roaring"
 )
 
-type invertedBitmapMatcher struct {
-	bitmaps          map[string]*roaring.Bitmap
-	subPos           uint32
-	subscribers      map[uint32]Subscriber
-	deletedPositions []uint32
+// TopicSpaceMatcher is a Matcher whose topic space can be changed after it
+// is created.
+type TopicSpaceMatcher interface {
+	Matcher
+
+	// AddTopic adds the topic to the topic space so that it can be looked up.
+	// Existing Subscriptions which match the topic are indexed under it.
+	AddTopic(topic string)
+
+	// RemoveTopic removes the topic from the topic space.
+	RemoveTopic(topic string)
+}
+
+// topicNode is a node in a trie which indexes a topic space by constituent.
+// Children are keyed by the dictionary ID of their constituent, and nodes
+// which terminate a topic hold the topic's bitmap of type B.
+type topicNode[B any] struct {
+	id       uint32
+	topic    bool
+	bitmap   B
+	parent   *topicNode[B]
+	children map[uint32]*topicNode[B]
+}
+
+func newTopicNode[B any](id uint32, parent *topicNode[B]) *topicNode[B] {
+	return &topicNode[B]{
+		id:       id,
+		parent:   parent,
+		children: make(map[uint32]*topicNode[B]),
+	}
+}
+
+// insert adds the topic with the given bitmap below the node.
+func (n *topicNode[B]) insert(constituents []uint32, bitmap B) {
+	curr := n
+	for _, constituent := range constituents {
+		child, ok := curr.children[constituent]
+		if !ok {
+			child = newTopicNode(constituent, curr)
+			curr.children[constituent] = child
+		}
+		curr = child
+	}
+	curr.topic = true
+	curr.bitmap = bitmap
+}
+
+// remove removes the topic below the node, pruning nodes which no longer lead
+// to a topic.
+func (n *topicNode[B]) remove(constituents []uint32) {
+	curr := n
+	for _, constituent := range constituents {
+		child, ok := curr.children[constituent]
+		if !ok {
+			return
+		}
+		curr = child
+	}
+	var none B
+	curr.topic = false
+	curr.bitmap = none
+	for curr.parent != nil && !curr.topic && len(curr.children) == 0 {
+		delete(curr.parent.children, curr.id)
+		curr = curr.parent
+	}
+}
+
+// matching calls fn with the bitmap of every topic below the node which
+// matches the subscription constituents. Only the matching paths are visited.
+func (n *topicNode[B]) matching(constituents []uint32, fn func(B)) {
+	if len(constituents) == 0 {
+		if n.topic {
+			fn(n.bitmap)
+		}
+		return
+	}
+	if constituents[0] == wildcardID {
+		for _, child := range n.children {
+			child.matching(constituents[1:], fn)
+		}
+		return
+	}
+	if child, ok := n.children[constituents[0]]; ok {
+		child.matching(constituents[1:], fn)
+	}
+}
+
+// invertedBitmapMatcher maps each topic in its topic space to a bitmap of
+// the subscription positions whose filter matches it. Positions are of type
+// P and held in bitmaps of type B, which are 32- or 64-bit roaring bitmaps.
+type invertedBitmapMatcher[P position, B positionBitmap[P, B]] struct {
+	bitmaps          map[string]B
+	topicIndex       *topicNode[B]
+	ops              *bitmapOps[P, B]
+	learn            bool
+	maxTopics        int
+	subPos           P
+	subscribers      map[P]Subscriber
+	topics           map[P]string
+	positions        positionIndex[P]
+	watchers         *watchers
+	deletedPositions []P
+	remap            *remapTable
+	registry         *SubscriberRegistry
+	dictionary       *wordDictionary
 	mu               sync.RWMutex
 }
 
-func NewInvertedBitmapMatcher(topicSpace []string) Matcher {
-	bitmaps := make(map[string]*roaring.Bitmap)
-	for _, topic := range topicSpace {
-		bitmaps[topic] = roaring.New()
+func NewInvertedBitmapMatcher(topicSpace []string) TopicSpaceMatcher {
+	return newInvertedBitmapMatcher(bitmaps32, topicSpace, false, 0)
+}
+
+// NewLearningInvertedBitmapMatcher returns an inverted bitmap matcher which
+// adds topics to its topic space as they are looked up rather than dropping
+// them. Since the topic space grows to fit, Subscriptions which don't match
+// any known topic are accepted. Topics with wildcards aren't learned, but
+// the topic space is otherwise unbounded, so topics from untrusted sources
+// should be looked up with NewLearningInvertedBitmapMatcherWithLimit.
+func NewLearningInvertedBitmapMatcher(topicSpace []string) TopicSpaceMatcher {
+	return newInvertedBitmapMatcher(bitmaps32, topicSpace, true, 0)
+}
+
+// NewLearningInvertedBitmapMatcherWithLimit returns a learning inverted
+// bitmap matcher which stops learning once its topic space holds maxTopics
+// topics. Topics looked up after that are matched against every Subscription
+// instead.
+func NewLearningInvertedBitmapMatcherWithLimit(topicSpace []string, maxTopics int) TopicSpaceMatcher {
+	return newInvertedBitmapMatcher(bitmaps32, topicSpace, true, maxTopics)
+}
+
+// NewInvertedBitmapMatcher64 returns an inverted bitmap matcher with 64-bit
+// subscription positions for the given topic space, so it isn't limited to
+// 2^32 subscription positions.
+func NewInvertedBitmapMatcher64(topicSpace []string) TopicSpaceMatcher {
+	return newInvertedBitmapMatcher(bitmaps64, topicSpace, false, 0)
+}
+
+// NewLearningInvertedBitmapMatcher64 is NewLearningInvertedBitmapMatcher with
+// 64-bit subscription positions. Topics from untrusted sources should be
+// looked up with NewLearningInvertedBitmapMatcher64WithLimit.
+func NewLearningInvertedBitmapMatcher64(topicSpace []string) TopicSpaceMatcher {
+	return newInvertedBitmapMatcher(bitmaps64, topicSpace, true, 0)
+}
+
+// NewLearningInvertedBitmapMatcher64WithLimit is
+// NewLearningInvertedBitmapMatcherWithLimit with 64-bit subscription
+// positions.
+func NewLearningInvertedBitmapMatcher64WithLimit(topicSpace []string, maxTopics int) TopicSpaceMatcher {
+	return newInvertedBitmapMatcher(bitmaps64, topicSpace, true, maxTopics)
+}
+
+func newInvertedBitmapMatcher[P position, B positionBitmap[P, B]](ops *bitmapOps[P, B], topicSpace []string, learn bool, maxTopics int) *invertedBitmapMatcher[P, B] {
+	b := &invertedBitmapMatcher[P, B]{
+		bitmaps:          make(map[string]B),
+		topicIndex:       newTopicNode[B](noWord, nil),
+		ops:              ops,
+		learn:            learn,
+		maxTopics:        maxTopics,
+		subscribers:      make(map[P]Subscriber),
+		topics:           make(map[P]string),
+		positions:        make(positionIndex[P]),
+		watchers:         newWatchers(),
+		deletedPositions: []P{},
+		remap:            newRemapTable(),
+		registry:         NewSubscriberRegistry(),
+		dictionary:       newWordDictionary(),
 	}
-	return &invertedBitmapMatcher{
-		bitmaps:          bitmaps,
-		subscribers:      make(map[uint32]Subscriber),
-		deletedPositions: []uint32{},
+	for _, topic := range topicSpace {
+		b.addTopic(canonicalTopic(topic))
 	}
+	return b
 }
 
-func (b *invertedBitmapMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+func (b *invertedBitmapMatcher[P, B]) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	topic = canonicalTopic(topic)
+	b.mu.Lock()
 	var (
 		pos       = b.subPos
 		reclaimed = false
 	)
-	b.mu.Lock()
 	if len(b.deletedPositions) > 0 {
 		pos = b.deletedPositions[0]
 		b.deletedPositions = b.deletedPositions[1:]
@@ -40,14 +194,13 @@ func (b *invertedBitmapMatcher) Subscribe(topic string, sub Subscriber) (*Subscr
 	}
 
 	match := false
-	for t, bitmap := range b.bitmaps {
-		if matchCriteria(t, topic) {
-			bitmap.Add(pos)
-			match = true
-		}
-	}
+	var buf [wordBufferSize]uint32
+	b.topicIndex.matching(b.dictionary.lookup(topic, buf[:0]), func(bm B) {
+		bm.Add(pos)
+		match = true
+	})
 
-	if !match {
+	if !match && !b.learn {
 		if reclaimed {
 			b.deletedPositions = append(b.deletedPositions, pos)
 		}
@@ -60,34 +213,188 @@ func (b *invertedBitmapMatcher) Subscribe(topic string, sub Subscriber) (*Subscr
 	}
 
 	b.subscribers[pos] = sub
+	b.topics[pos] = topic
+	b.positions.add(pos, sub)
+	b.registry.acquire(sub)
+	b.watchers.subscribed(topic)
+	b.mu.Unlock()
+	return &Subscription{id: uint64(pos), epoch: b.remap.epoch, topic: topic, subscriber: sub}, nil
+}
+
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (b *invertedBitmapMatcher[P, B]) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return b.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (b *invertedBitmapMatcher[P, B]) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return b.Subscribe(joinFilter(words), sub)
+}
+
+func (b *invertedBitmapMatcher[P, B]) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	id, ok := b.remap.resolve(sub)
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	pos := P(id)
+	if _, ok := b.subscribers[pos]; !ok {
+		// Already unsubscribed.
+		b.mu.Unlock()
+		return
+	}
+	b.release(pos)
+	b.mu.Unlock()
+}
+
+// UnsubscribeAll removes all Subscriptions for the Subscriber.
+func (b *invertedBitmapMatcher[P, B]) UnsubscribeAll(sub Subscriber) {
+	b.mu.Lock()
+	for _, pos := range b.positions.removeAll(sub) {
+		b.release(pos)
+	}
+	b.mu.Unlock()
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern.
+func (b *invertedBitmapMatcher[P, B]) UnsubscribeMatching(pattern string) {
+	b.unsubscribePattern(pattern, covers)
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix.
+func (b *invertedBitmapMatcher[P, B]) UnsubscribePrefix(prefix string) {
+	b.unsubscribePattern(prefix, coversPrefix)
+}
+
+func (b *invertedBitmapMatcher[P, B]) unsubscribePattern(pattern string, match func(pattern, filter string) bool) {
+	b.mu.Lock()
+	for pos, topic := range b.topics {
+		if match(pattern, topic) {
+			b.release(pos)
+		}
+	}
 	b.mu.Unlock()
-	return &Subscription{id: pos, topic: topic, subscriber: sub}, nil
 }
 
-func (b *invertedBitmapMatcher) Unsubscribe(sub *Subscription) {
+// release removes the subscription position from the bitmaps of the topics
+// its filter matches and frees it for reuse. The caller must hold the write
+// lock.
+func (b *invertedBitmapMatcher[P, B]) release(pos P) {
+	var buf [wordBufferSize]uint32
+	b.topicIndex.matching(b.dictionary.lookup(b.topics[pos], buf[:0]), func(bm B) {
+		bm.Remove(pos)
+	})
+	sub := b.subscribers[pos]
+	b.positions.remove(pos, sub)
+	b.registry.release(sub)
+	b.remap.release(uint64(pos))
+	b.watchers.unsubscribed(b.topics[pos])
+	b.deletedPositions = append(b.deletedPositions, pos)
+	delete(b.subscribers, pos)
+	delete(b.topics, pos)
+}
+
+// Compact renumbers the live subscriptions densely, starting from zero, and
+// rewrites the bitmaps to match. This reclaims the space held by freed
+// positions and lets the bitmaps use run containers. Outstanding Subscriptions
+// remain valid.
+func (b *invertedBitmapMatcher[P, B]) Compact() {
 	b.mu.Lock()
+	live := make([]uint64, 0, len(b.subscribers))
+	for pos, _ := range b.subscribers {
+		live = append(live, uint64(pos))
+	}
+	mapping := densePositions(live)
 	for _, bm := range b.bitmaps {
-		bm.Remove(sub.id)
+		b.ops.remap(bm, mapping)
 	}
-	b.deletedPositions = append(b.deletedPositions, sub.id)
-	delete(b.subscribers, sub.id)
+	var (
+		subscribers = make(map[P]Subscriber, len(mapping))
+		topics      = make(map[P]string, len(mapping))
+		positions   = make(positionIndex[P])
+	)
+	for oldPos, newPos := range mapping {
+		subscribers[P(newPos)] = b.subscribers[P(oldPos)]
+		topics[P(newPos)] = b.topics[P(oldPos)]
+		positions.add(P(newPos), b.subscribers[P(oldPos)])
+	}
+	b.subscribers = subscribers
+	b.topics = topics
+	b.positions = positions
+	b.subPos = P(len(mapping))
+	b.deletedPositions = []P{}
+	b.remap.renumber(mapping)
 	b.mu.Unlock()
 }
 
-// Lookup returns the Subscribers for the given topic.
-func (b *invertedBitmapMatcher) Lookup(topic string) []Subscriber {
+// Topics returns the topics the Subscriber is subscribed to.
+func (b *invertedBitmapMatcher[P, B]) Topics(sub Subscriber) []string {
 	b.mu.RLock()
-	bm, ok := b.bitmaps[topic]
-	if !ok {
-		b.mu.RUnlock()
-		return nil
+	topics := positionTopics(b.positions[sub], b.topics)
+	b.mu.RUnlock()
+	return topics
+}
+
+// Watch returns a Watcher which receives filter-level change Events.
+func (b *invertedBitmapMatcher[P, B]) Watch() *Watcher {
+	return b.watchers.watch()
+}
+
+// AddTopic adds the topic to the topic space and indexes the existing
+// Subscriptions which match it.
+func (b *invertedBitmapMatcher[P, B]) AddTopic(topic string) {
+	b.mu.Lock()
+	b.addTopic(canonicalTopic(topic))
+	b.mu.Unlock()
+}
+
+// addTopic adds the topic to the topic space if it isn't already present and
+// returns its bitmap. The caller must hold the write lock.
+func (b *invertedBitmapMatcher[P, B]) addTopic(topic string) B {
+	if bm, ok := b.bitmaps[topic]; ok {
+		return bm
+	}
+	// A learned topic may alias a buffer passed to LookupBytes.
+	topic = strings.Clone(topic)
+	bm := b.ops.new()
+	for pos, filter := range b.topics {
+		if matchCriteria(topic, filter) {
+			bm.Add(pos)
+		}
 	}
+	b.bitmaps[topic] = bm
+	var buf [wordBufferSize]uint32
+	b.topicIndex.insert(b.dictionary.intern(topic, buf[:0]), bm)
+	return bm
+}
 
-	subscriberSet := make(map[Subscriber]struct{}, bm.GetCardinality())
-	for iter := bm.Iterator(); iter.HasNext(); {
-		subscriberSet[b.subscribers[iter.Next()]] = struct{}{}
+// RemoveTopic removes the topic from the topic space. Subscriptions which
+// match it are kept.
+func (b *invertedBitmapMatcher[P, B]) RemoveTopic(topic string) {
+	topic = canonicalTopic(topic)
+	b.mu.Lock()
+	if _, ok := b.bitmaps[topic]; ok {
+		delete(b.bitmaps, topic)
+		var buf [wordBufferSize]uint32
+		b.topicIndex.remove(b.dictionary.lookup(topic, buf[:0]))
+		b.dictionary.release(topic)
+	}
+	b.mu.Unlock()
+}
+
+// Lookup returns the Subscribers for the given topic. If the topic is not in
+// the topic space, nil is returned unless the matcher learns topics, in which
+// case the topic is added. Topics with wildcards are never learned.
+func (b *invertedBitmapMatcher[P, B]) Lookup(topic string) []Subscriber {
+	subscriberSet := make(map[Subscriber]struct{})
+	if !b.visit(topic, func(sub Subscriber) { subscriberSet[sub] = struct{}{} }) {
+		return nil
 	}
-	b.mu.RUnlock()
 
 	subscribers := make([]Subscriber, len(subscriberSet))
 	i := 0
@@ -98,21 +405,95 @@ func (b *invertedBitmapMatcher) Lookup(topic string) []Subscriber {
 	return subscribers
 }
 
-func matchCriteria(topic, request string) bool {
-	var (
-		requestConstituents = strings.Split(request, delimiter)
-		topicConstituents   = strings.Split(topic, delimiter)
-	)
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (b *invertedBitmapMatcher[P, B]) LookupBytes(topic []byte) []Subscriber {
+	return b.Lookup(bytesToString(topic))
+}
 
-	if len(requestConstituents) != len(topicConstituents) {
-		return false
-	}
+// LookupWords returns the Subscribers for the topic made of the words.
+func (b *invertedBitmapMatcher[P, B]) LookupWords(words []string) []Subscriber {
+	return b.Lookup(JoinWords(words...))
+}
+
+// LookupBitmap returns the IDs of the Subscribers for the given topic. Like
+// Lookup, the topic is added to the topic space if the matcher learns topics.
+func (b *invertedBitmapMatcher[P, B]) LookupBitmap(topic string) *roaring.Bitmap {
+	ids := roaring.New()
+	b.visit(topic, func(sub Subscriber) {
+		if id, ok := b.registry.ID(sub); ok {
+			ids.Add(id)
+		}
+	})
+	return ids
+}
 
-	for i, constituent := range topicConstituents {
-		if constituent != requestConstituents[i] && requestConstituents[i] != wildcard {
+// Registry returns the SubscriberRegistry which assigns Subscriber IDs.
+func (b *invertedBitmapMatcher[P, B]) Registry() *SubscriberRegistry {
+	return b.registry
+}
+
+// visit calls fn with the Subscriber of each subscription matching the topic.
+// False is returned if the topic is not in the topic space and the matcher
+// doesn't learn topics, or the topic has wildcards and so can't be learned.
+func (b *invertedBitmapMatcher[P, B]) visit(topic string, fn func(Subscriber)) bool {
+	topic = canonicalTopic(topic)
+	b.mu.RLock()
+	bm, ok := b.bitmaps[topic]
+	if !ok {
+		b.mu.RUnlock()
+		if !b.learn || hasWildcard(topic) {
 			return false
 		}
+		b.mu.Lock()
+		if _, ok := b.bitmaps[topic]; !ok && b.maxTopics > 0 && len(b.bitmaps) >= b.maxTopics {
+			// The topic space is full, so the topic is matched without
+			// being learned.
+			for pos, filter := range b.topics {
+				if matchCriteria(topic, filter) {
+					fn(b.subscribers[pos])
+				}
+			}
+			b.mu.Unlock()
+			return true
+		}
+		// The learned bitmap is read before the write lock is released,
+		// since a RemoveTopic and Unsubscribe could otherwise empty it and
+		// free its positions in between.
+		bm = b.addTopic(topic)
+		for iter := b.ops.iterator(bm); iter.HasNext(); {
+			fn(b.subscribers[iter.Next()])
+		}
+		b.mu.Unlock()
+		return true
 	}
-
+	for iter := b.ops.iterator(bm); iter.HasNext(); {
+		fn(b.subscribers[iter.Next()])
+	}
+	b.mu.RUnlock()
 	return true
 }
+
+// LookupPattern returns the Subscribers whose topic overlaps the filter.
+func (b *invertedBitmapMatcher[P, B]) LookupPattern(filter string) []Subscriber {
+	b.mu.RLock()
+	subscriberSet := make(map[Subscriber]struct{})
+	for pos, topic := range b.topics {
+		if Overlaps(topic, filter) {
+			subscriberSet[b.subscribers[pos]] = struct{}{}
+		}
+	}
+	b.mu.RUnlock()
+
+	subscribers := make([]Subscriber, len(subscriberSet))
+	i := 0
+	for sub, _ := range subscriberSet {
+		subscribers[i] = sub
+		i++
+	}
+	return subscribers
+}
+
+func matchCriteria(topic, request string) bool {
+	return topicMatches(request, topic)
+}
@@ -0,0 +1,208 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvertedBitmapMatcher64(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		topics = []string{
+			"forex",
+			"forex.gbp",
+			"forex.eur",
+			"forex.usd",
+			"forex.jpy",
+			"trade",
+			"trade.usd",
+			"trade.jpy",
+		}
+		ib = NewInvertedBitmapMatcher64(topics)
+		s0 = 0
+		s1 = 1
+		s2 = 2
+	)
+
+	sub0, err := ib.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	sub1, err := ib.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	sub2, err := ib.Subscribe("*", s2)
+	assert.NoError(err)
+	_, err = ib.Subscribe("foo.bar", s2)
+	assert.Equal(ErrBadTopic, err)
+
+	assertEqual(assert, []Subscriber{s0, s1}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s2}, ib.Lookup("forex"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("trade.jpy"))
+
+	ib.Unsubscribe(sub0)
+	ib.Unsubscribe(sub1)
+	ib.Unsubscribe(sub2)
+
+	assertEqual(assert, []Subscriber{}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("forex"))
+}
+
+func TestInvertedBitmapMatcher64LargePositions(t *testing.T) {
+	assert := assert.New(t)
+	ib := newInvertedBitmapMatcher(bitmaps64, []string{"forex.eur", "forex.usd"}, false, 0)
+	ib.subPos = 1 << 40
+
+	sub0, err := ib.Subscribe("forex.*", 0)
+	assert.NoError(err)
+	sub1, err := ib.Subscribe("forex.eur", 1)
+	assert.NoError(err)
+	assert.Equal(uint64(1<<40), sub0.id)
+	assert.Equal(uint64(1<<40+1), sub1.id)
+	assertEqual(assert, []Subscriber{0, 1}, ib.Lookup("forex.eur"))
+
+	ib.Unsubscribe(sub0)
+	assertEqual(assert, []Subscriber{1}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("forex.usd"))
+}
+
+func TestLearningInvertedBitmapMatcher64(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewLearningInvertedBitmapMatcher64(nil)
+		s0 = 0
+		s1 = 1
+	)
+
+	_, err := ib.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("forex.eur"))
+
+	_, err = ib.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0, s1}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s1}, ib.Lookup("trade.eur"))
+
+	// Filters aren't learned as topics.
+	assert.Nil(ib.Lookup("forex.*"))
+	assert.NotContains(ib.(*invertedBitmapMatcher[uint64, *roaring64.Bitmap]).bitmaps, "forex.*")
+}
+
+func TestLearningInvertedBitmapMatcher64WithLimit(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewLearningInvertedBitmapMatcher64WithLimit([]string{"forex.eur"}, 2)
+		s0 = 0
+		s1 = 1
+	)
+
+	_, err := ib.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	_, err = ib.Subscribe("*.usd", s1)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0, s1}, ib.Lookup("forex.usd"))
+
+	// Once the topic space is full, topics are matched without being learned.
+	assertEqual(assert, []Subscriber{s1}, ib.Lookup("trade.usd"))
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("forex.gbp"))
+	assert.Len(ib.(*invertedBitmapMatcher[uint64, *roaring64.Bitmap]).bitmaps, 2)
+	assert.Contains(ib.(*invertedBitmapMatcher[uint64, *roaring64.Bitmap]).bitmaps, "forex.usd")
+}
+
+func BenchmarkInvertedBitmapMatcher64Subscribe(b *testing.B) {
+	var (
+		topics = []string{
+			"forex",
+			"forex.gbp",
+			"forex.eur",
+			"forex.usd",
+			"trade",
+			"trade.usd",
+			"trade.jpy",
+			"foo.bar.baz.qux.quux",
+		}
+		ib = NewInvertedBitmapMatcher64(topics)
+		s0 = 0
+	)
+	populateMatcher(ib, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ib.Subscribe("foo.*.baz.qux.quux", s0)
+	}
+}
+
+func BenchmarkInvertedBitmapMatcher64Unsubscribe(b *testing.B) {
+	var (
+		topics = []string{
+			"forex",
+			"forex.gbp",
+			"forex.eur",
+			"forex.usd",
+			"trade",
+			"trade.usd",
+			"trade.jpy",
+			"foo.bar.baz.qux.quux",
+		}
+		ib = NewInvertedBitmapMatcher64(topics)
+		s0 = 0
+	)
+	id, _ := ib.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(ib, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ib.Unsubscribe(id)
+	}
+}
+
+func BenchmarkInvertedBitmapMatcher64Lookup(b *testing.B) {
+	var (
+		topics = []string{
+			"forex",
+			"forex.gbp",
+			"forex.eur",
+			"forex.usd",
+			"trade",
+			"trade.usd",
+			"trade.jpy",
+			"foo.bar.baz.qux.quux",
+		}
+		ib = NewInvertedBitmapMatcher64(topics)
+		s0 = 0
+	)
+	ib.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(ib, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ib.Lookup("foo.bar.baz.qux.quux")
+	}
+}
+
+func BenchmarkMultithreaded4Thread5050InvertedBitmap64(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		topics := []string{}
+		for _, s := range items {
+			for _, item := range s {
+				topics = append(topics, item)
+			}
+		}
+		return NewInvertedBitmapMatcher64(topics)
+	})
+}
+
+func BenchmarkMultithreaded4Thread9010InvertedBitmap64(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		topics := []string{}
+		for _, s := range items {
+			for _, item := range s {
+				topics = append(topics, item)
+			}
+		}
+		return NewInvertedBitmapMatcher64(topics)
+	})
+}
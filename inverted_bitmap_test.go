@@ -1,8 +1,10 @@
 package matching
 
 import (
+	"strconv"
 	"testing"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -62,6 +64,87 @@ func TestInvertedBitmapMatcher(t *testing.T) {
 	assertEqual(assert, []Subscriber{}, ib.Lookup("trade"))
 }
 
+func TestInvertedBitmapMatcherDynamicTopicSpace(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewInvertedBitmapMatcher([]string{"forex.eur"})
+		s0 = 0
+		s1 = 1
+	)
+
+	_, err := ib.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	_, err = ib.Subscribe("forex.usd", s1)
+	assert.Equal(ErrBadTopic, err)
+	assert.Nil(ib.Lookup("forex.usd"))
+
+	ib.AddTopic("forex.usd")
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("forex.usd"))
+	_, err = ib.Subscribe("forex.usd", s1)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0, s1}, ib.Lookup("forex.usd"))
+
+	ib.RemoveTopic("forex.usd")
+	assert.Nil(ib.Lookup("forex.usd"))
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("forex.eur"))
+}
+
+func TestLearningInvertedBitmapMatcher(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewLearningInvertedBitmapMatcher(nil)
+		s0 = 0
+		s1 = 1
+	)
+
+	_, err := ib.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("forex.eur"))
+
+	_, err = ib.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0, s1}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s1}, ib.Lookup("trade.eur"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("trade"))
+
+	// Filters aren't learned as topics.
+	assert.Nil(ib.Lookup("forex.*"))
+	assert.NotContains(ib.(*invertedBitmapMatcher[uint32, *roaring.Bitmap]).bitmaps, "forex.*")
+}
+
+func TestLearningInvertedBitmapMatcherWithLimit(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewLearningInvertedBitmapMatcherWithLimit([]string{"forex.eur"}, 2)
+		s0 = 0
+		s1 = 1
+	)
+
+	_, err := ib.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	_, err = ib.Subscribe("*.usd", s1)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0, s1}, ib.Lookup("forex.usd"))
+
+	// Once the topic space is full, topics are matched without being learned.
+	assertEqual(assert, []Subscriber{s1}, ib.Lookup("trade.usd"))
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("forex.gbp"))
+	assert.Len(ib.(*invertedBitmapMatcher[uint32, *roaring.Bitmap]).bitmaps, 2)
+	assert.Contains(ib.(*invertedBitmapMatcher[uint32, *roaring.Bitmap]).bitmaps, "forex.usd")
+}
+
+func TestLearningInvertedBitmapMatcherConcurrentRemoveTopic(t *testing.T) {
+	matchers := map[string]func(topicSpace []string) TopicSpaceMatcher{
+		"learning inverted":   NewLearningInvertedBitmapMatcher,
+		"learning inverted64": NewLearningInvertedBitmapMatcher64,
+	}
+	for name, newMatcher := range matchers {
+		t.Run(name, func(t *testing.T) {
+			testConcurrentLearning(assert.New(t), newMatcher(nil))
+		})
+	}
+}
+
 func BenchmarkInvertedBitmapMatcherSubscribe(b *testing.B) {
 	var (
 		topics = []string{
@@ -109,6 +192,24 @@ func BenchmarkInvertedBitmapMatcherUnsubscribe(b *testing.B) {
 	}
 }
 
+func BenchmarkInvertedBitmapMatcherSubscribeLargeTopicSpace(b *testing.B) {
+	topics := make([]string, 0, 100000)
+	for i := 0; i < cap(topics); i++ {
+		topics = append(topics, "region."+strconv.Itoa(i%100)+".device."+strconv.Itoa(i))
+	}
+	var (
+		ib = NewInvertedBitmapMatcher(topics)
+		s0 = 0
+	)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sub, _ := ib.Subscribe("region.7.*.*", s0)
+		ib.Unsubscribe(sub)
+	}
+}
+
 func BenchmarkInvertedBitmapMatcherLookup(b *testing.B) {
 	var (
 		topics = []string{
@@ -0,0 +1,483 @@
+package matching
+
+import (
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// lockNode is a trie node guarded by its own lock. Locks are always taken
+// from parent to child, so traversals can't deadlock with one another.
+// Children are keyed by the dictionary ID of their word.
+type lockNode struct {
+	id       uint32
+	subs     map[Subscriber]struct{}
+	parent   *lockNode
+	children map[uint32]*lockNode
+
+	// removed is set once the node has been pruned from its parent.
+	removed bool
+	mu      sync.RWMutex
+}
+
+func newLockNode(id uint32, parent *lockNode) *lockNode {
+	return &lockNode{
+		id:       id,
+		subs:     make(map[Subscriber]struct{}),
+		parent:   parent,
+		children: make(map[uint32]*lockNode),
+	}
+}
+
+func (n *lockNode) isEmpty() bool {
+	return len(n.subs) == 0 && len(n.children) == 0
+}
+
+// orphan removes the node from its parent if it has neither Subscribers nor
+// children, then does the same for the parent. The node must not be locked
+// by the caller, since the parent's lock has to be taken first. Both locks
+// are held while the node is checked and removed, so a concurrent insert
+// either sees the node removed or adds to it before it is checked.
+func (n *lockNode) orphan() {
+	for n.parent != nil {
+		parent := n.parent
+		parent.mu.Lock()
+		n.mu.Lock()
+		if n.removed || !n.isEmpty() {
+			n.mu.Unlock()
+			parent.mu.Unlock()
+			return
+		}
+		n.removed = true
+		delete(parent.children, n.id)
+		n.mu.Unlock()
+		empty := parent.isEmpty()
+		parent.mu.Unlock()
+		if !empty {
+			return
+		}
+		n = parent
+	}
+}
+
+// lockingTrieMatcher is a trie matcher with a lock per node. Writers lock
+// their way down the trie hand over hand, holding a read lock on each node
+// until the next one is locked and write-locking only the nodes they modify.
+// Lookups hold a node's read lock only while they read it. Writers to
+// disjoint subtrees only share read locks on their common ancestors, and
+// their bookkeeping beside the trie doesn't lock, so they never wait on one
+// another.
+type lockingTrieMatcher struct {
+	root *lockNode
+
+	// index is the reverse index from Subscribers to topics. It sits beside
+	// the trie and is updated after a node is unlocked, from the trie as read
+	// again during the update, so that racing operations on a Subscription
+	// leave it agreeing with the trie.
+	index      syncIndex
+	watchers   *watchers
+	registry   *SubscriberRegistry
+	dictionary *wordDictionary
+}
+
+// NewLockingTrieMatcher returns a trie Matcher whose nodes are locked
+// individually rather than with a single lock for the whole trie.
+func NewLockingTrieMatcher() Matcher {
+	return &lockingTrieMatcher{
+		root:       newLockNode(noWord, nil),
+		watchers:   newWatchers(),
+		registry:   NewSubscriberRegistry(),
+		dictionary: newWordDictionary(),
+	}
+}
+
+// Subscribe adds the Subscriber to the topic and returns a Subscription.
+func (t *lockingTrieMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	topic = canonicalTopic(topic)
+	var buf [wordBufferSize]uint32
+	words := t.dictionary.intern(topic, buf[:0])
+	for !t.insert(topic, words, sub) {
+		// A node on the path was pruned while it was unlocked.
+	}
+	// The index takes its own references to the words of the Subscriptions
+	// it holds, so the ones taken for the insertion are given back.
+	t.dictionary.release(topic)
+	return &Subscription{topic: topic, subscriber: sub}, nil
+}
+
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (t *lockingTrieMatcher) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return t.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (t *lockingTrieMatcher) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return t.Subscribe(joinFilter(words), sub)
+}
+
+// insert adds the Subscriber at the end of the word path, creating nodes as
+// needed, and indexes the Subscription once the node is unlocked. False is
+// returned if the operation needs to be retried.
+func (t *lockingTrieMatcher) insert(topic string, words []uint32, sub Subscriber) bool {
+	curr := t.root
+	curr.mu.RLock()
+	for i, word := range words {
+		last := i == len(words)-1
+		child, ok := curr.children[word]
+		if ok {
+			lockChild(child, last)
+			curr.mu.RUnlock()
+			curr = child
+			continue
+		}
+
+		// Upgrade to add the child. The node may be pruned while unlocked.
+		curr.mu.RUnlock()
+		curr.mu.Lock()
+		if curr.removed {
+			curr.mu.Unlock()
+			return false
+		}
+		child, ok = curr.children[word]
+		if !ok {
+			child = newLockNode(word, curr)
+			curr.children[word] = child
+		}
+		lockChild(child, last)
+		curr.mu.Unlock()
+		curr = child
+	}
+	_, had := curr.subs[sub]
+	first := len(curr.subs) == 0
+	curr.subs[sub] = struct{}{}
+	curr.mu.Unlock()
+	if !had {
+		// A concurrent Unsubscribe may have removed the Subscriber again.
+		t.reindex(topic, sub)
+		if first {
+			t.syncWatchers(topic)
+		}
+	}
+	return true
+}
+
+// lockChild write-locks the node if it is the last on the path and
+// read-locks it otherwise.
+func lockChild(n *lockNode, last bool) {
+	if last {
+		n.mu.Lock()
+	} else {
+		n.mu.RLock()
+	}
+}
+
+// Unsubscribe removes the Subscription.
+func (t *lockingTrieMatcher) Unsubscribe(sub *Subscription) {
+	t.unsubscribe(sub.topic, sub.subscriber)
+}
+
+// UnsubscribeAll removes all Subscriptions for the Subscriber.
+func (t *lockingTrieMatcher) UnsubscribeAll(sub Subscriber) {
+	for _, topic := range t.index.topics(sub) {
+		t.unsubscribe(topic, sub)
+	}
+}
+
+// unsubscribe removes the Subscriber from the topic, pruning nodes left
+// without Subscribers or children, and unindexes the Subscription once the
+// node is unlocked.
+func (t *lockingTrieMatcher) unsubscribe(topic string, sub Subscriber) {
+	var buf [wordBufferSize]uint32
+	words := t.dictionary.lookup(topic, buf[:0])
+	curr := t.root
+	curr.mu.RLock()
+	for i, word := range words {
+		child, ok := curr.children[word]
+		if !ok {
+			// Subscription doesn't exist.
+			curr.mu.RUnlock()
+			return
+		}
+		lockChild(child, i == len(words)-1)
+		curr.mu.RUnlock()
+		curr = child
+	}
+	_, had := curr.subs[sub]
+	delete(curr.subs, sub)
+	empty := curr.isEmpty()
+	curr.mu.Unlock()
+	if empty {
+		curr.orphan()
+	}
+	if had {
+		// A concurrent Subscribe may have inserted the Subscriber again.
+		t.reindex(topic, sub)
+		if !t.hasSubscribers(topic) {
+			// Had the topic gained Subscribers since, whoever added the
+			// first would update the Watchers.
+			t.syncWatchers(topic)
+		}
+	}
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern.
+func (t *lockingTrieMatcher) UnsubscribeMatching(pattern string) {
+	var buf [wordBufferSize]uint32
+	t.unsubscribePattern(t.dictionary.lookup(pattern, buf[:0]), false)
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix.
+func (t *lockingTrieMatcher) UnsubscribePrefix(prefix string) {
+	var buf [wordBufferSize]uint32
+	t.unsubscribePattern(t.dictionary.lookup(prefix, buf[:0]), true)
+}
+
+// unsubscribePattern collects the Subscriptions covered by the pattern and
+// removes them one at a time.
+func (t *lockingTrieMatcher) unsubscribePattern(pattern []uint32, prefix bool) {
+	var covered []Subscription
+	t.covered(t.root, pattern, nil, prefix, func(topic string, sub Subscriber) {
+		covered = append(covered, Subscription{topic: topic, subscriber: sub})
+	})
+	for _, sub := range covered {
+		t.unsubscribe(sub.topic, sub.subscriber)
+	}
+}
+
+// covered calls fn with the Subscriptions below the node which are covered
+// by the pattern. If prefix is true, every Subscription in the subtrees the
+// pattern leads to is covered. Each node is read-locked only while it is
+// read.
+func (t *lockingTrieMatcher) covered(n *lockNode, pattern, path []uint32, prefix bool, fn func(string, Subscriber)) {
+	n.mu.RLock()
+	if len(pattern) == 0 {
+		// The words of the node's Subscriptions can't be forgotten while it
+		// is locked.
+		if topic, ok := t.dictionary.join(path); ok {
+			for sub, _ := range n.subs {
+				fn(topic, sub)
+			}
+		}
+		if !prefix {
+			n.mu.RUnlock()
+			return
+		}
+	}
+	var children []*lockNode
+	switch {
+	case len(pattern) == 0 || pattern[0] == wildcardID:
+		children = make([]*lockNode, 0, len(n.children))
+		for _, child := range n.children {
+			children = append(children, child)
+		}
+	default:
+		// A literal word only covers its own child.
+		if child, ok := n.children[pattern[0]]; ok {
+			children = append(children, child)
+		}
+	}
+	n.mu.RUnlock()
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	for _, child := range children {
+		t.covered(child, pattern, append(path, child.id), prefix, fn)
+	}
+}
+
+// reindex brings the index's record of the Subscription in line with the
+// trie after an operation has changed it. The index holds a reference to the
+// topic's words and the Subscriber's ID for each Subscription it records.
+func (t *lockingTrieMatcher) reindex(topic string, sub Subscriber) {
+	subscribed := func() (ok bool) {
+		t.leaf(topic, func(n *lockNode) {
+			_, ok = n.subs[sub]
+		})
+		return ok
+	}
+	switch t.index.update(topic, sub, subscribed) {
+	case 1:
+		var buf [wordBufferSize]uint32
+		t.dictionary.intern(topic, buf[:0])
+		t.registry.acquire(sub)
+	case -1:
+		t.dictionary.release(topic)
+		t.registry.release(sub)
+	}
+}
+
+// syncWatchers updates the Watchers after an operation gave the topic its
+// first or took its last Subscriber.
+func (t *lockingTrieMatcher) syncWatchers(topic string) {
+	t.watchers.sync(topic, func() bool { return t.hasSubscribers(topic) })
+}
+
+// hasSubscribers indicates if the topic has any Subscribers in the trie.
+func (t *lockingTrieMatcher) hasSubscribers(topic string) (ok bool) {
+	t.leaf(topic, func(n *lockNode) {
+		ok = len(n.subs) > 0
+	})
+	return ok
+}
+
+// leaf calls fn with the node at the end of the topic's word path, under its
+// read lock, if the trie has one. The words are looked up afresh, since a
+// topic's words are only forgotten once no Subscription holds them, after
+// which any Subscription to it interns them anew.
+func (t *lockingTrieMatcher) leaf(topic string, fn func(*lockNode)) {
+	var buf [wordBufferSize]uint32
+	curr := t.root
+	curr.mu.RLock()
+	for _, word := range t.dictionary.lookup(topic, buf[:0]) {
+		child, ok := curr.children[word]
+		if !ok {
+			curr.mu.RUnlock()
+			return
+		}
+		child.mu.RLock()
+		curr.mu.RUnlock()
+		curr = child
+	}
+	fn(curr)
+	curr.mu.RUnlock()
+}
+
+// Topics returns the topics the Subscriber is subscribed to.
+func (t *lockingTrieMatcher) Topics(sub Subscriber) []string {
+	return t.index.topics(sub)
+}
+
+// Watch returns a Watcher which receives filter-level change Events.
+func (t *lockingTrieMatcher) Watch() *Watcher {
+	return t.watchers.watch()
+}
+
+// Lookup returns the Subscribers for the given topic.
+func (t *lockingTrieMatcher) Lookup(topic string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return t.lookupIDs(t.dictionary.lookup(topic, buf[:0]))
+}
+
+// lookupIDs returns the Subscribers for the topic made of the words with the
+// given IDs.
+func (t *lockingTrieMatcher) lookupIDs(words []uint32) []Subscriber {
+	subMap := make(map[Subscriber]struct{})
+	t.lookup(words, t.root, subMap)
+	var (
+		subs = make([]Subscriber, len(subMap))
+		i    = 0
+	)
+	for sub, _ := range subMap {
+		subs[i] = sub
+		i++
+	}
+	return subs
+}
+
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (t *lockingTrieMatcher) LookupBytes(topic []byte) []Subscriber {
+	return t.Lookup(bytesToString(topic))
+}
+
+// LookupWords returns the Subscribers for the topic made of the words.
+func (t *lockingTrieMatcher) LookupWords(words []string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return t.lookupIDs(t.dictionary.lookupWords(words, buf[:0]))
+}
+
+// LookupBitmap returns the IDs of the Subscribers for the given topic.
+func (t *lockingTrieMatcher) LookupBitmap(topic string) *roaring.Bitmap {
+	var (
+		buf    [wordBufferSize]uint32
+		subMap = make(map[Subscriber]struct{})
+	)
+	t.lookup(t.dictionary.lookup(topic, buf[:0]), t.root, subMap)
+	return t.registry.bitmap(subMap)
+}
+
+// Registry returns the SubscriberRegistry which assigns Subscriber IDs.
+func (t *lockingTrieMatcher) Registry() *SubscriberRegistry {
+	return t.registry
+}
+
+// lookup adds the Subscribers below the node for the topic word IDs to subs.
+// The node is read-locked only while it is read, so a lookup never holds a
+// lock while it descends and doesn't keep writers out of the nodes it has
+// passed.
+func (t *lockingTrieMatcher) lookup(words []uint32, node *lockNode, subs map[Subscriber]struct{}) {
+	node.mu.RLock()
+	if len(words) == 0 {
+		for sub, _ := range node.subs {
+			subs[sub] = struct{}{}
+		}
+		node.mu.RUnlock()
+		return
+	}
+	literal := node.children[words[0]]
+	var wild *lockNode
+	if words[0] != wildcardID {
+		wild = node.children[wildcardID]
+	}
+	node.mu.RUnlock()
+	if literal != nil {
+		t.lookup(words[1:], literal, subs)
+	}
+	if wild != nil {
+		t.lookup(words[1:], wild, subs)
+	}
+}
+
+// LookupPattern returns the Subscribers whose topic overlaps the filter.
+func (t *lockingTrieMatcher) LookupPattern(filter string) []Subscriber {
+	var (
+		buf    [wordBufferSize]uint32
+		subMap = make(map[Subscriber]struct{})
+	)
+	t.lookupPattern(t.dictionary.lookup(filter, buf[:0]), t.root, subMap)
+	var (
+		subs = make([]Subscriber, len(subMap))
+		i    = 0
+	)
+	for sub, _ := range subMap {
+		subs[i] = sub
+		i++
+	}
+	return subs
+}
+
+// lookupPattern adds the Subscribers below the node whose topics overlap the
+// filter word IDs to subs. Every child is followed where the filter has a
+// wildcard. Like lookup, it read-locks each node only while it reads it.
+func (t *lockingTrieMatcher) lookupPattern(words []uint32, node *lockNode, subs map[Subscriber]struct{}) {
+	node.mu.RLock()
+	if len(words) == 0 {
+		for sub, _ := range node.subs {
+			subs[sub] = struct{}{}
+		}
+		node.mu.RUnlock()
+		return
+	}
+	var children []*lockNode
+	if words[0] == wildcardID {
+		children = make([]*lockNode, 0, len(node.children))
+		for _, child := range node.children {
+			children = append(children, child)
+		}
+	} else {
+		if child, ok := node.children[words[0]]; ok {
+			children = append(children, child)
+		}
+		if child, ok := node.children[wildcardID]; ok {
+			children = append(children, child)
+		}
+	}
+	node.mu.RUnlock()
+	for _, child := range children {
+		t.lookupPattern(words[1:], child, subs)
+	}
+}
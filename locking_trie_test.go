@@ -0,0 +1,290 @@
+package matching
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockingTrieMatcher(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		m  = NewLockingTrieMatcher()
+		s0 = 0
+		s1 = 1
+		s2 = 2
+	)
+
+	sub0, err := m.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	sub1, err := m.Subscribe("*.usd", s0)
+	assert.NoError(err)
+	sub2, err := m.Subscribe("forex.eur", s0)
+	assert.NoError(err)
+	sub3, err := m.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	sub4, err := m.Subscribe("forex.*", s1)
+	assert.NoError(err)
+	sub5, err := m.Subscribe("trade", s1)
+	assert.NoError(err)
+	sub6, err := m.Subscribe("*", s2)
+	assert.NoError(err)
+
+	assertEqual(assert, []Subscriber{s0, s1}, m.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s2}, m.Lookup("forex"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade.jpy"))
+	assertEqual(assert, []Subscriber{s0, s1}, m.Lookup("forex.jpy"))
+	assertEqual(assert, []Subscriber{s1, s2}, m.Lookup("trade"))
+
+	m.Unsubscribe(sub0)
+	m.Unsubscribe(sub1)
+	m.Unsubscribe(sub2)
+	m.Unsubscribe(sub3)
+	m.Unsubscribe(sub4)
+	m.Unsubscribe(sub5)
+	m.Unsubscribe(sub6)
+
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade.jpy"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.jpy"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade"))
+}
+
+func TestLockingTrieMatcherConcurrentPrune(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		m  = NewLockingTrieMatcher()
+		wg sync.WaitGroup
+	)
+
+	// Subscribers churn on overlapping paths so that nodes are pruned while
+	// other goroutines insert below them.
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			region := []string{"eu", "us"}[i%2]
+			for j := 0; j < 500; j++ {
+				topic := region + ".orders." + strconv.Itoa(j%5)
+				sub, err := m.Subscribe(topic, i)
+				assert.NoError(err)
+				assert.Contains(m.Lookup(topic), i)
+				m.Unsubscribe(sub)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	root := m.(*lockingTrieMatcher).root
+	assert.Empty(root.children)
+	assertEqual(assert, []Subscriber{}, m.Lookup("eu.orders.0"))
+
+	_, err := m.Subscribe("eu.orders.0", 0)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{0}, m.Lookup("eu.orders.0"))
+}
+
+func BenchmarkLockingTrieMatcherSubscribe(b *testing.B) {
+	var (
+		m  = NewLockingTrieMatcher()
+		s0 = 0
+	)
+	populateMatcher(m, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Subscribe("foo.*.baz.qux.quux", s0)
+	}
+}
+
+func BenchmarkLockingTrieMatcherUnsubscribe(b *testing.B) {
+	var (
+		m  = NewLockingTrieMatcher()
+		s0 = 0
+	)
+	id, _ := m.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(m, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Unsubscribe(id)
+	}
+}
+
+// Measures writers which each churn a Subscription in their own subtree, so
+// that they only share the root's read lock. Each subtree keeps another
+// Subscription so that its nodes and words aren't dropped on every
+// iteration.
+func BenchmarkLockingTrieMatcherDisjointSubscribe(b *testing.B) {
+	var (
+		m    = NewLockingTrieMatcher()
+		next atomic.Int64
+	)
+	populateMatcher(m, 1000, 5)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var (
+			n     = next.Add(1)
+			topic = "disjoint" + strconv.FormatInt(n, 10) + ".a.b"
+		)
+		m.Subscribe(topic, -n)
+		for pb.Next() {
+			sub, _ := m.Subscribe(topic, n)
+			m.Unsubscribe(sub)
+		}
+	})
+}
+
+func BenchmarkLockingTrieMatcherLookup(b *testing.B) {
+	var (
+		m  = NewLockingTrieMatcher()
+		s0 = 0
+	)
+	m.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(m, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Lookup("foo.bar.baz.qux.quux")
+	}
+}
+
+func BenchmarkLockingTrieMatcherSubscribeCold(b *testing.B) {
+	var (
+		m  = NewLockingTrieMatcher()
+		s0 = 0
+	)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Subscribe("foo.*.baz.qux.quux", s0)
+	}
+}
+
+func BenchmarkLockingTrieMatcherUnsubscribeCold(b *testing.B) {
+	var (
+		m  = NewLockingTrieMatcher()
+		s0 = 0
+	)
+	id, _ := m.Subscribe("foo.*.baz.qux.quux", s0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Unsubscribe(id)
+	}
+}
+
+func BenchmarkLockingTrieMatcherLookupCold(b *testing.B) {
+	var (
+		m  = NewLockingTrieMatcher()
+		s0 = 0
+	)
+	m.Subscribe("foo.*.baz.qux.quux", s0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Lookup("foo.bar.baz.qux.quux")
+	}
+}
+
+func BenchmarkMultithreaded1Thread5050LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 1
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded2Thread5050LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 2
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded4Thread5050LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded8Thread5050LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 8
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded12Thread5050LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 12
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded16Thread5050LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 16
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded1Thread9010LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 1
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded2Thread9010LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 2
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded4Thread9010LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded8Thread9010LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 8
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded12Thread9010LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 12
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded16Thread9010LockingTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 16
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewLockingTrieMatcher()
+	})
+}
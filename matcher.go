@@ -1,8 +1,11 @@
 package matching
 
+import "github.com/RoaringBitmap/roaring"
+
 const (
 	delimiter = "."
 	wildcard  = "*"
+	escape    = `\`
 	empty     = ""
 )
 
@@ -11,19 +14,93 @@ type Subscriber interface{}
 
 // Subscription represents a topic subscription.
 type Subscription struct {
-	id         uint32
+	id         uint64
+	epoch      uint32
 	topic      string
 	subscriber Subscriber
 }
 
 // Matcher contains topic subscriptions and performs matches on them.
+//
+// A topic is a sequence of words separated by the delimiter ".", and a "*"
+// word in a subscription's topic matches any single word. A backslash escapes
+// a following ".", "*" or backslash: "\." is a dot within a word, "\\" is a
+// backslash and a "\*" word is a literal "*" matched only by itself or a
+// wildcard. Before any other character, a backslash stands for itself.
+// EscapeWord and JoinWords build topics from raw words safely.
 type Matcher interface {
 	// Subscribe adds the Subscriber to the topic and returns a Subscription.
 	Subscribe(topic string, sub Subscriber) (*Subscription, error)
 
+	// SubscribeBytes is like Subscribe but takes the topic as a byte slice.
+	// The topic is copied, so the slice may be reused once it returns.
+	SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error)
+
+	// SubscribeWords is like Subscribe but takes the topic's words rather
+	// than the topic. The words are taken literally, so they may contain the
+	// delimiter, except that a "*" word is a wildcard.
+	SubscribeWords(words []string, sub Subscriber) (*Subscription, error)
+
 	// Unsubscribe removes the Subscription.
 	Unsubscribe(sub *Subscription)
 
 	// Lookup returns the Subscribers for the given topic.
 	Lookup(topic string) []Subscriber
+
+	// LookupBytes is like Lookup but takes the topic as a byte slice, e.g. a
+	// slice into a network read buffer. The topic is neither copied nor
+	// retained, so the slice may be reused once it returns.
+	LookupBytes(topic []byte) []Subscriber
+
+	// LookupWords is like Lookup but takes the topic's words rather than the
+	// topic, sparing callers which build topics from parts a join and split.
+	// The words are taken literally, so they may contain the delimiter and a
+	// "*" word is a literal "*".
+	LookupWords(words []string) []Subscriber
+
+	// LookupPattern returns the Subscribers whose topic filter overlaps the
+	// given filter, i.e. those which could receive a message published to a
+	// topic matched by it.
+	LookupPattern(filter string) []Subscriber
+
+	// Topics returns the topics the Subscriber is subscribed to.
+	Topics(sub Subscriber) []string
+
+	// UnsubscribeAll removes all Subscriptions for the Subscriber.
+	UnsubscribeAll(sub Subscriber)
+
+	// UnsubscribeMatching removes all Subscriptions whose topic is covered by
+	// the pattern, i.e. every topic the Subscription matches is also matched
+	// by the pattern.
+	UnsubscribeMatching(pattern string)
+
+	// UnsubscribePrefix removes all Subscriptions whose leading topic words
+	// are covered by the prefix, including those with deeper topics.
+	UnsubscribePrefix(prefix string)
+
+	// Watch returns a Watcher which receives an Event whenever a filter gains
+	// its first or loses its last Subscription.
+	Watch() *Watcher
+}
+
+// Compactor is implemented by Matchers which can compact their internal
+// representation after heavy churn.
+type Compactor interface {
+	// Compact rebuilds the Matcher's internal representation densely.
+	// Outstanding Subscriptions remain valid.
+	Compact()
+}
+
+// BitmapMatcher is implemented by Matchers which can return the Subscribers
+// for a topic as a bitmap of Subscriber IDs, so that callers can combine the
+// result with their own bitmaps without converting it to a slice and back.
+type BitmapMatcher interface {
+	Matcher
+
+	// LookupBitmap returns the IDs of the Subscribers for the given topic.
+	// The bitmap is owned by the caller.
+	LookupBitmap(topic string) *roaring.Bitmap
+
+	// Registry returns the SubscriberRegistry which assigns the IDs.
+	Registry() *SubscriberRegistry
 }
@@ -0,0 +1,97 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// matcherFactories creates each Matcher for the shared tests in TestMatchers.
+// Matchers with a fixed topic space are given the topics a test subscribes
+// to, and return nil if the test has none.
+var matcherFactories = map[string]func(topicSpace []string) Matcher{
+	"naive":   func([]string) Matcher { return NewNaiveMatcher() },
+	"trie":    func([]string) Matcher { return NewTrieMatcher() },
+	"rcu":     func([]string) Matcher { return NewRCUTrieMatcher() },
+	"locking": func([]string) Matcher { return NewLockingTrieMatcher() },
+	"cstrie":  func([]string) Matcher { return NewCSTrieMatcher() },
+	"sharded": func([]string) Matcher { return newShardedTrieMatcher() },
+	"inverted": func(topicSpace []string) Matcher {
+		if topicSpace == nil {
+			return nil
+		}
+		return NewInvertedBitmapMatcher(topicSpace)
+	},
+	"inverted64": func(topicSpace []string) Matcher {
+		if topicSpace == nil {
+			return nil
+		}
+		return NewInvertedBitmapMatcher64(topicSpace)
+	},
+	"learning inverted":   func([]string) Matcher { return NewLearningInvertedBitmapMatcher(nil) },
+	"learning inverted64": func([]string) Matcher { return NewLearningInvertedBitmapMatcher64(nil) },
+	"optimized":           func([]string) Matcher { return NewOptimizedInvertedBitmapMatcher(5) },
+	"optimized64":         func([]string) Matcher { return NewOptimizedInvertedBitmapMatcher64(5) },
+}
+
+func isBitmapMatcher(m Matcher) bool {
+	_, ok := m.(BitmapMatcher)
+	return ok
+}
+
+func isCompactor(m Matcher) bool {
+	_, ok := m.(Compactor)
+	return ok
+}
+
+// Ensures every Matcher passes the shared tests it supports.
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		name       string
+		topicSpace []string
+		supports   func(Matcher) bool
+		test       func(*assert.Assertions, Matcher)
+	}{
+		{name: "UnsubscribeAll", topicSpace: []string{"forex.eur", "forex.usd", "trade"}, test: testUnsubscribeAll},
+		{name: "ConcurrentResubscribe", test: testConcurrentResubscribe},
+		{name: "ConcurrentWatch", test: testConcurrentWatch},
+		{
+			name: "UnsubscribePattern",
+			topicSpace: []string{
+				"tenant42.a",
+				"tenant42.a.b",
+				"tenant42.a.b.c",
+				"tenant42.x.c",
+				"tenant7.a.b",
+			},
+			test: testUnsubscribePattern,
+		},
+		{name: "Watch", topicSpace: []string{"a.b", "a.c"}, test: testWatch},
+		{
+			name: "LookupPattern",
+			topicSpace: []string{
+				"orders.new",
+				"orders.new.eu",
+				"orders.x.us",
+				"trade.new.eu",
+			},
+			test: testLookupPattern,
+		},
+		{name: "Compact", topicSpace: []string{"forex.eur", "forex.usd"}, supports: isCompactor, test: testCompact},
+		{name: "LookupBitmap", topicSpace: []string{"forex.eur", "forex.usd", "trade.eur"}, supports: isBitmapMatcher, test: testLookupBitmap},
+		{name: "Bytes", test: testBytes},
+		{name: "Words", test: testWords},
+		{name: "Escapes", test: testEscapes},
+	}
+	for _, tt := range tests {
+		for name, newMatcher := range matcherFactories {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				m := newMatcher(tt.topicSpace)
+				if m == nil || (tt.supports != nil && !tt.supports(m)) {
+					t.Skip("the matcher doesn't support the test")
+				}
+				tt.test(assert.New(t), m)
+			})
+		}
+	}
+}
@@ -1,47 +1,122 @@
 package matching
 
-import (
-	"strings"
-	"sync"
-)
+import "sync"
 
 // naiveMatcher is an implementation of Matcher which is backed by a hashmap.
 type naiveMatcher struct {
-	subs map[string]map[Subscriber]struct{}
-	mu   sync.RWMutex
+	subs     map[string]map[Subscriber]struct{}
+	index    subscriptionIndex
+	watchers *watchers
+	mu       sync.RWMutex
 }
 
 func NewNaiveMatcher() Matcher {
-	return &naiveMatcher{subs: make(map[string]map[Subscriber]struct{})}
+	return &naiveMatcher{
+		subs:     make(map[string]map[Subscriber]struct{}),
+		index:    make(subscriptionIndex),
+		watchers: newWatchers(),
+	}
 }
 
 // Subscribe adds the Subscriber to the topic and returns a Subscription.
 func (n *naiveMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	topic = canonicalTopic(topic)
 	n.mu.Lock()
 	if _, ok := n.subs[topic]; !ok {
 		n.subs[topic] = make(map[Subscriber]struct{})
 	}
 	n.subs[topic][sub] = struct{}{}
+	if n.index.add(topic, sub) {
+		n.watchers.subscribed(topic)
+	}
 	n.mu.Unlock()
 	return &Subscription{topic: topic, subscriber: sub}, nil
 }
 
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (n *naiveMatcher) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return n.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (n *naiveMatcher) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return n.Subscribe(joinFilter(words), sub)
+}
+
 // Unsubscribe removes the Subscription.
 func (n *naiveMatcher) Unsubscribe(sub *Subscription) {
 	n.mu.Lock()
-	if subscribers, ok := n.subs[sub.topic]; ok {
-		for existing, _ := range subscribers {
-			if existing != sub.subscriber {
-				continue
-			}
+	n.unsubscribe(sub.topic, sub.subscriber)
+	n.mu.Unlock()
+}
+
+// UnsubscribeAll removes all Subscriptions for the Subscriber.
+func (n *naiveMatcher) UnsubscribeAll(sub Subscriber) {
+	n.mu.Lock()
+	for _, topic := range n.index.topics(sub) {
+		n.unsubscribe(topic, sub)
+	}
+	n.mu.Unlock()
+}
 
-			// Delete the subscriber from the list.
-			delete(n.subs[sub.topic], sub.subscriber)
+// unsubscribe removes the Subscriber from the topic. The caller must hold the
+// write lock.
+func (n *naiveMatcher) unsubscribe(topic string, sub Subscriber) {
+	if subscribers, ok := n.subs[topic]; ok {
+		// Delete the subscriber from the list.
+		delete(subscribers, sub)
+		if len(subscribers) == 0 {
+			delete(n.subs, topic)
 		}
 	}
+	if n.index.remove(topic, sub) {
+		n.watchers.unsubscribed(topic)
+	}
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern.
+func (n *naiveMatcher) UnsubscribeMatching(pattern string) {
+	n.unsubscribePattern(pattern, covers)
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix.
+func (n *naiveMatcher) UnsubscribePrefix(prefix string) {
+	n.unsubscribePattern(prefix, coversPrefix)
+}
+
+func (n *naiveMatcher) unsubscribePattern(pattern string, match func(pattern, filter string) bool) {
+	n.mu.Lock()
+	for topic, subscribers := range n.subs {
+		if !match(pattern, topic) {
+			continue
+		}
+		for sub, _ := range subscribers {
+			if n.index.remove(topic, sub) {
+				n.watchers.unsubscribed(topic)
+			}
+		}
+		delete(n.subs, topic)
+	}
 	n.mu.Unlock()
 }
 
+// Topics returns the topics the Subscriber is subscribed to.
+func (n *naiveMatcher) Topics(sub Subscriber) []string {
+	n.mu.RLock()
+	topics := n.index.topics(sub)
+	n.mu.RUnlock()
+	return topics
+}
+
+// Watch returns a Watcher which receives filter-level change Events.
+func (n *naiveMatcher) Watch() *Watcher {
+	return n.watchers.watch()
+}
+
 // Lookup returns the Subscribers for the given topic.
 func (n *naiveMatcher) Lookup(topic string) []Subscriber {
 	n.mu.RLock()
@@ -67,21 +142,56 @@ func (n *naiveMatcher) Lookup(topic string) []Subscriber {
 	return subscriberList
 }
 
-func topicMatches(sub, topic string) bool {
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (n *naiveMatcher) LookupBytes(topic []byte) []Subscriber {
+	return n.Lookup(bytesToString(topic))
+}
+
+// LookupWords returns the Subscribers for the topic made of the words.
+func (n *naiveMatcher) LookupWords(words []string) []Subscriber {
+	return n.Lookup(JoinWords(words...))
+}
+
+// LookupPattern returns the Subscribers whose topic overlaps the filter.
+func (n *naiveMatcher) LookupPattern(filter string) []Subscriber {
+	n.mu.RLock()
+	subscriberSet := make(map[Subscriber]struct{})
+	for existingTopic, subscribers := range n.subs {
+		if Overlaps(existingTopic, filter) {
+			for sub, x := range subscribers {
+				subscriberSet[sub] = x
+			}
+		}
+	}
+	n.mu.RUnlock()
+
 	var (
-		subConstituents   = strings.Split(sub, delimiter)
-		topicConstituents = strings.Split(topic, delimiter)
+		subscriberList = make([]Subscriber, len(subscriberSet))
+		i              = 0
 	)
-
-	if len(subConstituents) != len(topicConstituents) {
-		return false
+	for sub, _ := range subscriberSet {
+		subscriberList[i] = sub
+		i++
 	}
 
-	for i, constituent := range topicConstituents {
-		if constituent != subConstituents[i] && subConstituents[i] != wildcard {
+	return subscriberList
+}
+
+func topicMatches(sub, topic string) bool {
+	var (
+		subConstituents   = newTokenizer(sub)
+		topicConstituents = newTokenizer(topic)
+	)
+
+	for {
+		subConstituent, subOK := subConstituents.next()
+		constituent, topicOK := topicConstituents.next()
+		if !subOK || !topicOK {
+			return subOK == topicOK
+		}
+		if constituent != subConstituent && subConstituent != wildcard {
 			return false
 		}
 	}
-
-	return true
 }
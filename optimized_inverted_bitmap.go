@@ -2,7 +2,6 @@ package matching
 
 import (
 	"errors"
-	"strings"
 	"sync"
 
 	"github.com/RoaringBitmap/roaring"
@@ -10,146 +9,549 @@ import (
 
 var ErrBadTopic = errors.New("Topic does not fit within topic space")
 
-type constituentBitmap struct {
-	bitmaps map[string]*roaring.Bitmap
+// compactionThreshold is the minimum number of subscription removals between
+// compactions of an optimized inverted bitmap matcher.
+const compactionThreshold = 4096
+
+// probeThreshold is the largest intermediate lookup result which is
+// intersected with a level by probing each position rather than by ANDing
+// bitmaps.
+const probeThreshold = 64
+
+// constituentBitmap indexes the subscription positions at one level of the
+// topic by constituent. The ends bitmap holds the positions whose topic ends
+// at this level. The cardinality of each bitmap is tracked so that lookups
+// can order levels by selectivity without touching the bitmaps.
+type constituentBitmap[P position, B positionBitmap[P, B]] struct {
+	bitmaps     map[uint32]B
+	cardinality map[uint32]uint64
+	ends        B
+	endCount    uint64
+	ops         *bitmapOps[P, B]
 }
 
-func newConstituentBitmap() *constituentBitmap {
-	bitmaps := map[string]*roaring.Bitmap{
-		empty:    roaring.New(),
-		wildcard: roaring.New(),
+func newConstituentBitmap[P position, B positionBitmap[P, B]](ops *bitmapOps[P, B]) *constituentBitmap[P, B] {
+	bitmaps := map[uint32]B{
+		wildcardID: ops.new(),
+	}
+	return &constituentBitmap[P, B]{
+		bitmaps:     bitmaps,
+		cardinality: make(map[uint32]uint64),
+		ends:        ops.new(),
+		ops:         ops,
 	}
-	return &constituentBitmap{bitmaps: bitmaps}
 }
 
-func (c *constituentBitmap) index(constituent string, subPos uint32) {
+func (c *constituentBitmap[P, B]) index(constituent uint32, subPos P) {
 	bitmap, ok := c.bitmaps[constituent]
 	if !ok {
-		bitmap = roaring.New()
+		bitmap = c.ops.new()
 		c.bitmaps[constituent] = bitmap
 	}
-	bitmap.Add(subPos)
+	if bitmap.CheckedAdd(subPos) {
+		c.cardinality[constituent]++
+	}
 }
 
-func (c *constituentBitmap) lookup(constituent string) *roaring.Bitmap {
-	if constituent == empty {
-		return c.bitmaps[empty]
+// end records that the position's topic ends at this level.
+func (c *constituentBitmap[P, B]) end(subPos P) {
+	if c.ends.CheckedAdd(subPos) {
+		c.endCount++
 	}
-	bitmap := c.bitmaps[wildcard]
-	if bm, ok := c.bitmaps[constituent]; ok {
-		bitmap = roaring.FastOr(bitmap, bm)
+}
+
+// unend records that the position's topic no longer ends at this level.
+func (c *constituentBitmap[P, B]) unend(subPos P) {
+	if c.ends.CheckedRemove(subPos) {
+		c.endCount--
+	}
+}
+
+// unindex removes the position from the constituent's bitmap. The bitmap is
+// dropped once it is empty, except for the wildcard bitmap which always
+// exists.
+func (c *constituentBitmap[P, B]) unindex(constituent uint32, subPos P) {
+	if bitmap, ok := c.bitmaps[constituent]; ok {
+		if bitmap.CheckedRemove(subPos) {
+			c.cardinality[constituent]--
+		}
+		if constituent != wildcardID && bitmap.IsEmpty() {
+			delete(c.bitmaps, constituent)
+			delete(c.cardinality, constituent)
+		}
+	}
+}
+
+// compact drops empty bitmaps and optimizes the remaining ones for size.
+func (c *constituentBitmap[P, B]) compact() {
+	for constituent, bitmap := range c.bitmaps {
+		if constituent != wildcardID && bitmap.IsEmpty() {
+			delete(c.bitmaps, constituent)
+			delete(c.cardinality, constituent)
+			continue
+		}
+		bitmap.RunOptimize()
+	}
+	c.ends.RunOptimize()
+}
+
+// isEmpty indicates if no subscription reaches this level.
+func (c *constituentBitmap[P, B]) isEmpty() bool {
+	return len(c.bitmaps) == 1 && c.bitmaps[wildcardID].IsEmpty()
+}
+
+func (c *constituentBitmap[P, B]) lookup(constituent uint32) B {
+	bitmap := c.bitmaps[wildcardID]
+	if bm, ok := c.bitmaps[constituent]; ok && constituent != wildcardID {
+		bitmap = c.ops.fastOr(bitmap, bm)
 	}
 	return bitmap
 }
 
-type optimizedInvertedBitmapMatcher struct {
-	constituentBitmaps []*constituentBitmap
-	maxConstituents    uint
-	subscribers        map[uint32]Subscriber
-	subPos             uint32
-	deletedPositions   []uint32
+// estimate returns the number of positions matching the constituent at this
+// level.
+func (c *constituentBitmap[P, B]) estimate(constituent uint32) uint64 {
+	n := c.cardinality[wildcardID]
+	if constituent != wildcardID {
+		n += c.cardinality[constituent]
+	}
+	return n
+}
+
+// contains indicates if the position matches the constituent at this level.
+func (c *constituentBitmap[P, B]) contains(constituent uint32, subPos P) bool {
+	if c.bitmaps[wildcardID].Contains(subPos) {
+		return true
+	}
+	bm, ok := c.bitmaps[constituent]
+	return ok && bm.Contains(subPos)
+}
+
+// intersect returns the positions in result which match the constituent at
+// this level. Rather than materializing the union of the exact and wildcard
+// bitmaps, result is intersected with each and the smaller intersections are
+// combined.
+func (c *constituentBitmap[P, B]) intersect(result B, constituent uint32) B {
+	matched := c.ops.and(result, c.bitmaps[wildcardID])
+	if bm, ok := c.bitmaps[constituent]; ok && constituent != wildcardID {
+		matched.Or(c.ops.and(result, bm))
+	}
+	return matched
+}
+
+// covered returns the positions whose constituent is covered by the given
+// pattern word.
+func (c *constituentBitmap[P, B]) covered(pattern uint32) B {
+	if pattern != wildcardID {
+		if bm, ok := c.bitmaps[pattern]; ok {
+			return bm
+		}
+		return c.ops.new()
+	}
+	bitmaps := make([]B, 0, len(c.bitmaps))
+	for _, bm := range c.bitmaps {
+		bitmaps = append(bitmaps, bm)
+	}
+	return c.ops.fastOr(bitmaps...)
+}
+
+// optimizedInvertedBitmapMatcher indexes subscription positions of type P by
+// the constituent at each level of their topic, in bitmaps of type B which are
+// 32- or 64-bit roaring bitmaps.
+type optimizedInvertedBitmapMatcher[P position, B positionBitmap[P, B]] struct {
+	constituentBitmaps []*constituentBitmap[P, B]
+	ops                *bitmapOps[P, B]
+	subscribers        map[P]Subscriber
+	topics             map[P]string
+	positions          positionIndex[P]
+	watchers           *watchers
+	subPos             P
+	deletedPositions   []P
+	removals           int
+	remap              *remapTable
+	registry           *SubscriberRegistry
+	dictionary         *wordDictionary
 	mu                 sync.RWMutex
 }
 
+// NewOptimizedInvertedBitmapMatcher returns a Matcher which indexes
+// subscriptions by constituent. Bitmaps for topicSpaceSize levels are
+// allocated up front and more are added as deeper topics are subscribed to.
 func NewOptimizedInvertedBitmapMatcher(topicSpaceSize uint) Matcher {
-	bitmaps := make([]*constituentBitmap, topicSpaceSize)
+	return newOptimizedInvertedBitmapMatcher(bitmaps32, topicSpaceSize)
+}
+
+// NewOptimizedInvertedBitmapMatcher64 returns a Matcher which indexes
+// subscriptions by constituent using 64-bit subscription positions, so it
+// isn't limited to 2^32 subscription positions.
+func NewOptimizedInvertedBitmapMatcher64(topicSpaceSize uint) Matcher {
+	return newOptimizedInvertedBitmapMatcher(bitmaps64, topicSpaceSize)
+}
+
+func newOptimizedInvertedBitmapMatcher[P position, B positionBitmap[P, B]](ops *bitmapOps[P, B], topicSpaceSize uint) *optimizedInvertedBitmapMatcher[P, B] {
+	bitmaps := make([]*constituentBitmap[P, B], topicSpaceSize)
 	for i := uint(0); i < topicSpaceSize; i++ {
-		bitmaps[i] = newConstituentBitmap()
+		bitmaps[i] = newConstituentBitmap(ops)
 	}
-	return &optimizedInvertedBitmapMatcher{
+	return &optimizedInvertedBitmapMatcher[P, B]{
 		constituentBitmaps: bitmaps,
-		maxConstituents:    topicSpaceSize,
-		subscribers:        make(map[uint32]Subscriber),
-		deletedPositions:   []uint32{},
+		ops:                ops,
+		subscribers:        make(map[P]Subscriber),
+		topics:             make(map[P]string),
+		positions:          make(positionIndex[P]),
+		watchers:           newWatchers(),
+		deletedPositions:   []P{},
+		remap:              newRemapTable(),
+		registry:           NewSubscriberRegistry(),
+		dictionary:         newWordDictionary(),
 	}
 }
 
 // Subscribe adds the Subscriber to the topic and returns a Subscription.
-func (b *optimizedInvertedBitmapMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
-	constituents := strings.Split(topic, delimiter)
-	if uint(len(constituents)) > b.maxConstituents {
-		return nil, ErrBadTopic
-	}
-
+func (b *optimizedInvertedBitmapMatcher[P, B]) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	topic = canonicalTopic(topic)
 	var (
-		i           int
-		constituent string
-		pos         = b.subPos
+		buf          [wordBufferSize]uint32
+		constituents = b.dictionary.intern(topic, buf[:0])
+		pos          P
 	)
 
+	b.mu.Lock()
 	if len(b.deletedPositions) > 0 {
 		pos = b.deletedPositions[0]
 		b.deletedPositions = b.deletedPositions[1:]
 	} else {
+		pos = b.subPos
 		b.subPos++
 	}
 
-	b.mu.Lock()
-	for i, constituent = range constituents {
-		b.constituentBitmaps[i].index(constituent, pos)
+	for len(b.constituentBitmaps) < len(constituents) {
+		// Grow to fit the topic. Existing subscriptions end above the new
+		// levels, so nothing needs to be backfilled.
+		b.constituentBitmaps = append(b.constituentBitmaps, newConstituentBitmap(b.ops))
 	}
-	for i := uint(i + 1); i < b.maxConstituents; i++ {
-		b.constituentBitmaps[i].index(empty, pos)
+	for i, constituent := range constituents {
+		b.constituentBitmaps[i].index(constituent, pos)
 	}
+	b.constituentBitmaps[len(constituents)-1].end(pos)
 
 	b.subscribers[pos] = sub
+	b.topics[pos] = topic
+	b.positions.add(pos, sub)
+	b.registry.acquire(sub)
+	b.watchers.subscribed(topic)
 	b.mu.Unlock()
-	return &Subscription{id: pos, topic: topic, subscriber: sub}, nil
+	return &Subscription{id: uint64(pos), epoch: b.remap.epoch, topic: topic, subscriber: sub}, nil
+}
+
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (b *optimizedInvertedBitmapMatcher[P, B]) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return b.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (b *optimizedInvertedBitmapMatcher[P, B]) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return b.Subscribe(joinFilter(words), sub)
 }
 
 // Unsubscribe removes the Subscription.
-func (b *optimizedInvertedBitmapMatcher) Unsubscribe(sub *Subscription) {
-	constituents := strings.Split(sub.topic, delimiter)
+func (b *optimizedInvertedBitmapMatcher[P, B]) Unsubscribe(sub *Subscription) {
 	b.mu.Lock()
-	for i, cb := range b.constituentBitmaps {
-		if i == len(constituents) {
-			break
-		}
-		if bm, ok := cb.bitmaps[constituents[i]]; ok {
-			bm.Remove(sub.id)
-		}
+	id, ok := b.remap.resolve(sub)
+	if !ok {
+		b.mu.Unlock()
+		return
 	}
-	b.deletedPositions = append(b.deletedPositions, sub.id)
-	delete(b.subscribers, sub.id)
+	pos := P(id)
+	if _, ok := b.subscribers[pos]; !ok {
+		// Already unsubscribed.
+		b.mu.Unlock()
+		return
+	}
+	b.release(pos)
 	b.mu.Unlock()
 }
 
-// Lookup returns the Subscribers for the given topic.
-func (b *optimizedInvertedBitmapMatcher) Lookup(topic string) []Subscriber {
-	constituents := strings.Split(topic, delimiter)
-	if uint(len(constituents)) > b.maxConstituents {
-		return nil
+// UnsubscribeAll removes all Subscriptions for the Subscriber.
+func (b *optimizedInvertedBitmapMatcher[P, B]) UnsubscribeAll(sub Subscriber) {
+	b.mu.Lock()
+	for _, pos := range b.positions.removeAll(sub) {
+		b.release(pos)
 	}
+	b.mu.Unlock()
+}
 
-	bitmaps := make([]*roaring.Bitmap, b.maxConstituents)
-	var (
-		i           int
-		constituent string
-	)
-	b.mu.RLock()
-	for i, constituent = range constituents {
-		bitmaps[i] = b.constituentBitmaps[i].lookup(constituent)
-		if bitmaps[i].IsEmpty() {
-			// If we get an empty bitmap, there are no subscribers.
-			b.mu.RUnlock()
-			return nil
-		}
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern.
+func (b *optimizedInvertedBitmapMatcher[P, B]) UnsubscribeMatching(pattern string) {
+	var buf [wordBufferSize]uint32
+	b.unsubscribePattern(b.dictionary.lookup(pattern, buf[:0]), false)
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix.
+func (b *optimizedInvertedBitmapMatcher[P, B]) UnsubscribePrefix(prefix string) {
+	var buf [wordBufferSize]uint32
+	b.unsubscribePattern(b.dictionary.lookup(prefix, buf[:0]), true)
+}
+
+// unsubscribePattern removes the Subscriptions covered by the pattern by
+// intersecting the covered positions of each level. If prefix is false, the
+// Subscriptions must also end where the pattern does.
+func (b *optimizedInvertedBitmapMatcher[P, B]) unsubscribePattern(pattern []uint32, prefix bool) {
+	b.mu.Lock()
+	if len(pattern) > len(b.constituentBitmaps) {
+		b.mu.Unlock()
+		return
+	}
+	bitmaps := make([]B, 0, len(pattern)+1)
+	for i, word := range pattern {
+		bitmaps = append(bitmaps, b.constituentBitmaps[i].covered(word))
 	}
-	for i := uint(i + 1); i < b.maxConstituents; i++ {
-		bitmaps[i] = b.constituentBitmaps[i].lookup(empty)
+	if !prefix {
+		bitmaps = append(bitmaps, b.constituentBitmaps[len(pattern)-1].ends)
 	}
-	result := roaring.FastAnd(bitmaps...)
-	subscriberSet := make(map[Subscriber]struct{}, result.GetCardinality())
-	for iter := result.Iterator(); iter.HasNext(); {
-		subscriberSet[b.subscribers[iter.Next()]] = struct{}{}
+	for iter := b.ops.iterator(b.ops.fastAnd(bitmaps...)); iter.HasNext(); {
+		b.release(iter.Next())
 	}
+	b.mu.Unlock()
+}
+
+// release removes the subscription position from the bitmaps of each level of
+// its topic and frees it for reuse. The caller must hold the write lock.
+func (b *optimizedInvertedBitmapMatcher[P, B]) release(pos P) {
+	var buf [wordBufferSize]uint32
+	constituents := b.dictionary.lookup(b.topics[pos], buf[:0])
+	for i, constituent := range constituents {
+		b.constituentBitmaps[i].unindex(constituent, pos)
+	}
+	b.constituentBitmaps[len(constituents)-1].unend(pos)
+	b.dictionary.release(b.topics[pos])
+
+	sub := b.subscribers[pos]
+	b.positions.remove(pos, sub)
+	b.registry.release(sub)
+	b.remap.release(uint64(pos))
+	b.watchers.unsubscribed(b.topics[pos])
+	b.deletedPositions = append(b.deletedPositions, pos)
+	delete(b.subscribers, pos)
+	delete(b.topics, pos)
+
+	// Compact once the churn since the last compaction is comparable to the
+	// number of live subscriptions so that its cost is amortized.
+	b.removals++
+	if b.removals >= compactionThreshold && b.removals >= len(b.subscribers) {
+		b.compactBitmaps()
+	}
+}
+
+// compactBitmaps drops empty bitmaps, optimizes the remaining ones and trims levels
+// below the deepest subscription. The caller must hold the write lock.
+func (b *optimizedInvertedBitmapMatcher[P, B]) compactBitmaps() {
+	for _, cb := range b.constituentBitmaps {
+		cb.compact()
+	}
+	depth := len(b.constituentBitmaps)
+	for depth > 0 && b.constituentBitmaps[depth-1].isEmpty() {
+		b.constituentBitmaps[depth-1] = nil
+		depth--
+	}
+	b.constituentBitmaps = b.constituentBitmaps[:depth]
+	b.removals = 0
+}
+
+// Compact renumbers the live subscriptions densely, starting from zero, and
+// rewrites the bitmaps to match. This reclaims the space held by freed
+// positions and lets the bitmaps use run containers. Outstanding Subscriptions
+// remain valid.
+func (b *optimizedInvertedBitmapMatcher[P, B]) Compact() {
+	b.mu.Lock()
+	live := make([]uint64, 0, len(b.subscribers))
+	for pos, _ := range b.subscribers {
+		live = append(live, uint64(pos))
+	}
+	mapping := densePositions(live)
+	for _, cb := range b.constituentBitmaps {
+		for _, bm := range cb.bitmaps {
+			b.ops.remap(bm, mapping)
+		}
+		b.ops.remap(cb.ends, mapping)
+	}
+	var (
+		subscribers = make(map[P]Subscriber, len(mapping))
+		topics      = make(map[P]string, len(mapping))
+		positions   = make(positionIndex[P])
+	)
+	for oldPos, newPos := range mapping {
+		subscribers[P(newPos)] = b.subscribers[P(oldPos)]
+		topics[P(newPos)] = b.topics[P(oldPos)]
+		positions.add(P(newPos), b.subscribers[P(oldPos)])
+	}
+	b.subscribers = subscribers
+	b.topics = topics
+	b.positions = positions
+	b.subPos = P(len(mapping))
+	b.deletedPositions = []P{}
+	b.remap.renumber(mapping)
+	b.compactBitmaps()
+	b.mu.Unlock()
+}
+
+// Topics returns the topics the Subscriber is subscribed to.
+func (b *optimizedInvertedBitmapMatcher[P, B]) Topics(sub Subscriber) []string {
+	b.mu.RLock()
+	topics := positionTopics(b.positions[sub], b.topics)
 	b.mu.RUnlock()
+	return topics
+}
+
+// Watch returns a Watcher which receives filter-level change Events.
+func (b *optimizedInvertedBitmapMatcher[P, B]) Watch() *Watcher {
+	return b.watchers.watch()
+}
+
+// Lookup returns the Subscribers for the given topic.
+func (b *optimizedInvertedBitmapMatcher[P, B]) Lookup(topic string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return b.lookup(b.dictionary.lookup(topic, buf[:0]), false)
+}
+
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (b *optimizedInvertedBitmapMatcher[P, B]) LookupBytes(topic []byte) []Subscriber {
+	return b.Lookup(bytesToString(topic))
+}
+
+// LookupWords returns the Subscribers for the topic made of the words.
+func (b *optimizedInvertedBitmapMatcher[P, B]) LookupWords(words []string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return b.lookup(b.dictionary.lookupWords(words, buf[:0]), false)
+}
+
+// LookupBitmap returns the IDs of the Subscribers for the given topic.
+func (b *optimizedInvertedBitmapMatcher[P, B]) LookupBitmap(topic string) *roaring.Bitmap {
+	ids := roaring.New()
+	var buf [wordBufferSize]uint32
+	b.visit(b.dictionary.lookup(topic, buf[:0]), false, func(sub Subscriber) {
+		if id, ok := b.registry.ID(sub); ok {
+			ids.Add(id)
+		}
+	})
+	return ids
+}
+
+// Registry returns the SubscriberRegistry which assigns Subscriber IDs.
+func (b *optimizedInvertedBitmapMatcher[P, B]) Registry() *SubscriberRegistry {
+	return b.registry
+}
+
+// LookupPattern returns the Subscribers whose topic overlaps the filter. Where
+// the filter has a wildcard, every bitmap of that level is ORed together.
+func (b *optimizedInvertedBitmapMatcher[P, B]) LookupPattern(filter string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return b.lookup(b.dictionary.lookup(filter, buf[:0]), true)
+}
+
+// lookup returns the distinct Subscribers which visit finds.
+func (b *optimizedInvertedBitmapMatcher[P, B]) lookup(constituents []uint32, pattern bool) []Subscriber {
+	subscriberSet := make(map[Subscriber]struct{})
+	b.visit(constituents, pattern, func(sub Subscriber) {
+		subscriberSet[sub] = struct{}{}
+	})
 
 	subscribers := make([]Subscriber, len(subscriberSet))
-	i = 0
+	i := 0
 	for sub, _ := range subscriberSet {
 		subscribers[i] = sub
 		i++
 	}
 	return subscribers
 }
+
+// visit calls fn with the Subscriber of each subscription matching the
+// constituents. It intersects the bitmaps for each constituent with the bitmap
+// of topics ending at the last constituent. Levels are intersected from the
+// most selective to the least, stopping as soon as the result is empty. If
+// pattern is true, wildcard constituents match every subscription at their
+// level.
+func (b *optimizedInvertedBitmapMatcher[P, B]) visit(constituents []uint32, pattern bool, fn func(Subscriber)) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(constituents) > len(b.constituentBitmaps) {
+		// No subscriptions are this deep.
+		return
+	}
+	var (
+		last      = b.constituentBitmaps[len(constituents)-1]
+		levels    = make([]int, 0, len(constituents))
+		estimates = make([]uint64, len(constituents))
+	)
+	if last.endCount == 0 {
+		return
+	}
+	for i, constituent := range constituents {
+		if pattern && constituent == wildcardID {
+			// Every subscription ending at the last level reaches this one,
+			// so the ends bitmap already accounts for it.
+			continue
+		}
+		estimates[i] = b.constituentBitmaps[i].estimate(constituent)
+		if estimates[i] == 0 {
+			// If nothing matches this level, there are no subscribers.
+			return
+		}
+		levels = append(levels, i)
+	}
+	// Topics are short, so an insertion sort is cheapest.
+	for i := 1; i < len(levels); i++ {
+		for j := i; j > 0 && estimates[levels[j]] < estimates[levels[j-1]]; j-- {
+			levels[j], levels[j-1] = levels[j-1], levels[j]
+		}
+	}
+
+	var (
+		result      B
+		endsApplied = len(levels) == 0 || last.endCount <= estimates[levels[0]]
+	)
+	if endsApplied {
+		result = last.ends
+	} else {
+		result = b.constituentBitmaps[levels[0]].lookup(constituents[levels[0]])
+		levels = levels[1:]
+	}
+	for len(levels) > 0 && result.GetCardinality() > probeThreshold {
+		i := levels[0]
+		if !endsApplied && last.endCount <= estimates[i] {
+			result = b.ops.and(result, last.ends)
+			endsApplied = true
+			continue
+		}
+		result = b.constituentBitmaps[i].intersect(result, constituents[i])
+		levels = levels[1:]
+	}
+
+	// Once the result is small, the remaining levels are checked position by
+	// position, which is cheaper than building more bitmaps.
+	for iter := b.ops.iterator(result); iter.HasNext(); {
+		pos := iter.Next()
+		if !endsApplied && !last.ends.Contains(pos) {
+			continue
+		}
+		if b.matchesLevels(pos, constituents, levels) {
+			fn(b.subscribers[pos])
+		}
+	}
+}
+
+// matchesLevels indicates if the position matches the constituents at each of
+// the given levels. The caller must hold the read lock.
+func (b *optimizedInvertedBitmapMatcher[P, B]) matchesLevels(pos P, constituents []uint32, levels []int) bool {
+	for _, i := range levels {
+		if !b.constituentBitmaps[i].contains(constituents[i], pos) {
+			return false
+		}
+	}
+	return true
+}
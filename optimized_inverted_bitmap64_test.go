@@ -0,0 +1,115 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimizedInvertedBitmapMatcher64(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewOptimizedInvertedBitmapMatcher64(5)
+		s0 = 0
+		s1 = 1
+		s2 = 2
+	)
+
+	sub0, err := ib.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	sub1, err := ib.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	sub2, err := ib.Subscribe("*", s2)
+	assert.NoError(err)
+
+	assertEqual(assert, []Subscriber{s0, s1}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s2}, ib.Lookup("forex"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("trade.jpy"))
+
+	ib.Unsubscribe(sub0)
+	ib.Unsubscribe(sub1)
+	ib.Unsubscribe(sub2)
+
+	assertEqual(assert, []Subscriber{}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("forex"))
+}
+
+func TestOptimizedInvertedBitmapMatcher64LargePositions(t *testing.T) {
+	assert := assert.New(t)
+	ib := NewOptimizedInvertedBitmapMatcher64(2).(*optimizedInvertedBitmapMatcher[uint64, *roaring64.Bitmap])
+	ib.subPos = 1 << 40
+
+	sub0, err := ib.Subscribe("forex.*", 0)
+	assert.NoError(err)
+	sub1, err := ib.Subscribe("forex.eur", 1)
+	assert.NoError(err)
+	assert.Equal(uint64(1<<40), sub0.id)
+	assert.Equal(uint64(1<<40+1), sub1.id)
+	assertEqual(assert, []Subscriber{0, 1}, ib.Lookup("forex.eur"))
+
+	ib.Unsubscribe(sub0)
+	assertEqual(assert, []Subscriber{1}, ib.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("forex.usd"))
+
+	ib.Compact()
+	assertEqual(assert, []Subscriber{1}, ib.Lookup("forex.eur"))
+	assert.Equal(uint64(1), ib.subPos)
+}
+
+func BenchmarkOptimizedInvertedBitmapMatcher64Subscribe(b *testing.B) {
+	var (
+		ib = NewOptimizedInvertedBitmapMatcher64(5)
+		s0 = 0
+	)
+	populateMatcher(ib, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ib.Subscribe("foo.*.baz.qux.quux", s0)
+	}
+}
+
+func BenchmarkOptimizedInvertedBitmapMatcher64Unsubscribe(b *testing.B) {
+	var (
+		ib = NewOptimizedInvertedBitmapMatcher64(5)
+		s0 = 0
+	)
+	id, _ := ib.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(ib, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ib.Unsubscribe(id)
+	}
+}
+
+func BenchmarkOptimizedInvertedBitmapMatcher64Lookup(b *testing.B) {
+	var (
+		ib = NewOptimizedInvertedBitmapMatcher64(5)
+		s0 = 0
+	)
+	ib.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(ib, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ib.Lookup("foo.bar.baz.qux.quux")
+	}
+}
+
+func BenchmarkMultithreaded4Thread5050OptimizedInvertedBitmap64(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewOptimizedInvertedBitmapMatcher64(uint(numItems))
+	})
+}
+
+func BenchmarkMultithreaded4Thread9010OptimizedInvertedBitmap64(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewOptimizedInvertedBitmapMatcher64(uint(numItems))
+	})
+}
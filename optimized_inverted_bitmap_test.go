@@ -1,8 +1,10 @@
 package matching
 
 import (
+	"strconv"
 	"testing"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,6 +53,93 @@ func TestOptimizedInvertedBitmapMatcher(t *testing.T) {
 	assertEqual(assert, []Subscriber{}, ib.Lookup("trade"))
 }
 
+func TestOptimizedInvertedBitmapMatcherGrowth(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewOptimizedInvertedBitmapMatcher(1)
+		s0 = 0
+		s1 = 1
+		s2 = 2
+	)
+
+	_, err := ib.Subscribe("a", s0)
+	assert.NoError(err)
+	sub1, err := ib.Subscribe("a.*.c.d", s1)
+	assert.NoError(err)
+	_, err = ib.Subscribe("a.b.c.d.e.f", s2)
+	assert.NoError(err)
+
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("a"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("a.b"))
+	assertEqual(assert, []Subscriber{s1}, ib.Lookup("a.b.c.d"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("a.b.c.d.e"))
+	assertEqual(assert, []Subscriber{s2}, ib.Lookup("a.b.c.d.e.f"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("a.b.c.d.e.f.g"))
+
+	ib.Unsubscribe(sub1)
+	assertEqual(assert, []Subscriber{}, ib.Lookup("a.b.c.d"))
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("a"))
+}
+
+func TestOptimizedInvertedBitmapMatcherCleanup(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib = NewOptimizedInvertedBitmapMatcher(3).(*optimizedInvertedBitmapMatcher[uint32, *roaring.Bitmap])
+		s0 = 0
+	)
+
+	_, err := ib.Subscribe("a", s0)
+	assert.NoError(err)
+	sub, err := ib.Subscribe("a.b.c", s0)
+	assert.NoError(err)
+	ib.Unsubscribe(sub)
+
+	assert.NotContains(ib.constituentBitmaps[1].bitmaps, "b")
+	assert.NotContains(ib.constituentBitmaps[2].bitmaps, "c")
+	assert.True(ib.constituentBitmaps[2].ends.IsEmpty())
+
+	for i := 1; i < compactionThreshold; i++ {
+		sub, err := ib.Subscribe("x.y.z.w", s0)
+		assert.NoError(err)
+		ib.Unsubscribe(sub)
+	}
+
+	// Levels below the deepest subscription are trimmed by compaction.
+	assert.Len(ib.constituentBitmaps, 1)
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("a"))
+	assertEqual(assert, []Subscriber{}, ib.Lookup("x.y.z.w"))
+
+	_, err = ib.Subscribe("a.b.c", s0)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0}, ib.Lookup("a.b.c"))
+}
+
+func TestOptimizedInvertedBitmapMatcherSelectivity(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		ib      = NewOptimizedInvertedBitmapMatcher(3)
+		naive   = NewNaiveMatcher()
+		filters = enumerate([]string{"a", "b", wildcard}, 3)
+	)
+	// Skew the levels so that they are intersected in different orders.
+	for i, filter := range filters {
+		for j := 0; j <= i%4; j++ {
+			sub := Subscriber(strconv.Itoa(i*4 + j))
+			_, err := ib.Subscribe(filter, sub)
+			assert.NoError(err)
+			_, err = naive.Subscribe(filter, sub)
+			assert.NoError(err)
+		}
+	}
+
+	for _, topic := range enumerate([]string{"a", "b", "c"}, 4) {
+		assertEqual(assert, naive.Lookup(topic), ib.Lookup(topic))
+	}
+	for _, filter := range enumerate([]string{"a", "c", wildcard}, 4) {
+		assertEqual(assert, naive.LookupPattern(filter), ib.LookupPattern(filter))
+	}
+}
+
 func BenchmarkOptimizedInvertedBitmapMatcherSubscribe(b *testing.B) {
 	var (
 		ib = NewOptimizedInvertedBitmapMatcher(5)
@@ -92,6 +181,24 @@ func BenchmarkOptimizedInvertedBitmapMatcherLookup(b *testing.B) {
 	}
 }
 
+func BenchmarkOptimizedInvertedBitmapMatcherLookupSelective(b *testing.B) {
+	var (
+		ib = NewOptimizedInvertedBitmapMatcher(5)
+		s0 = 0
+	)
+	// The leading levels match nearly every subscription while the last one
+	// matches only a few.
+	for i := 0; i < 10000; i++ {
+		ib.Subscribe("foo.*.baz.qux."+strconv.Itoa(i), s0)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ib.Lookup("foo.bar.baz.qux.42")
+	}
+}
+
 func BenchmarkOptimizedInvertedBitmapMatcherSubscribeCold(b *testing.B) {
 	var (
 		ib = NewOptimizedInvertedBitmapMatcher(5)
@@ -0,0 +1,419 @@
+package matching
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// rcuNode is a node in a trie which is never modified once it is published.
+// Writers copy the nodes along the path they change instead. Children are
+// keyed by the dictionary ID of their word and held in a persistent hamt, so
+// copying a node doesn't copy its children.
+type rcuNode struct {
+	subs     map[Subscriber]struct{}
+	children hamt[*rcuNode]
+}
+
+// clone returns a copy of the node which can be modified until it is
+// published. The copy shares the node's Subscribers, so they must be replaced
+// rather than modified, as withSub and withoutSub do. A nil node clones to an
+// empty one.
+func (n *rcuNode) clone() *rcuNode {
+	if n == nil {
+		return &rcuNode{}
+	}
+	c := *n
+	return &c
+}
+
+// withSub returns a copy of the node with the Subscriber added.
+func (n *rcuNode) withSub(sub Subscriber) *rcuNode {
+	c := n.clone()
+	subs := make(map[Subscriber]struct{}, len(c.subs)+1)
+	for s, _ := range c.subs {
+		subs[s] = struct{}{}
+	}
+	subs[sub] = struct{}{}
+	c.subs = subs
+	return c
+}
+
+// withoutSub returns a copy of the node without the Subscriber, or nil if
+// the copy would be empty.
+func (n *rcuNode) withoutSub(sub Subscriber) *rcuNode {
+	c := n.clone()
+	c.subs = make(map[Subscriber]struct{}, len(n.subs))
+	for s, _ := range n.subs {
+		if s != sub {
+			c.subs[s] = struct{}{}
+		}
+	}
+	if c.isEmpty() {
+		return nil
+	}
+	return c
+}
+
+func (n *rcuNode) isEmpty() bool {
+	return len(n.subs) == 0 && n.children.len() == 0
+}
+
+// update returns a copy of the node in which the node at the end of the word
+// path is replaced with the result of fn. Only the nodes along the path are
+// copied. Nodes left without Subscribers or children are pruned, in which
+// case nil is returned.
+func (n *rcuNode) update(words []uint32, fn func(*rcuNode) *rcuNode) *rcuNode {
+	if len(words) == 0 {
+		return fn(n)
+	}
+	var child *rcuNode
+	if n != nil {
+		child = n.children.get(words[0])
+	}
+	c := n.clone()
+	if updated := child.update(words[1:], fn); updated != nil {
+		c.children = c.children.with(words[0], updated)
+	} else {
+		c.children = c.children.without(words[0])
+	}
+	if c.isEmpty() {
+		return nil
+	}
+	return c
+}
+
+// rcuTrieMatcher is a trie matcher whose readers never take a lock. Readers
+// load the current root and traverse an immutable trie, while writers are
+// serialized, copy the path they modify and publish a new root. This avoids
+// contention on a shared reader count at the cost of allocating on every
+// write.
+type rcuTrieMatcher struct {
+	root       atomic.Pointer[rcuNode]
+	index      subscriptionIndex
+	watchers   *watchers
+	registry   *SubscriberRegistry
+	dictionary *wordDictionary
+	mu         sync.Mutex
+
+	// unindexed holds the topics of the Subscriptions removed since the last
+	// publish, whose words are released once readers can no longer find them.
+	unindexed []string
+}
+
+// NewRCUTrieMatcher returns a trie Matcher suited to read-heavy workloads.
+// Lookups are lock-free and writes copy the modified path of the trie.
+func NewRCUTrieMatcher() Matcher {
+	t := &rcuTrieMatcher{
+		index:      make(subscriptionIndex),
+		watchers:   newWatchers(),
+		registry:   NewSubscriberRegistry(),
+		dictionary: newWordDictionary(),
+	}
+	t.root.Store((*rcuNode)(nil).clone())
+	return t
+}
+
+// publish makes the root visible to readers, then releases the words of the
+// Subscriptions removed from it. Releasing them any earlier would let a
+// reader miss a Subscription which is still published. The caller must hold
+// the lock.
+func (t *rcuTrieMatcher) publish(root *rcuNode) {
+	if root == nil {
+		root = (*rcuNode)(nil).clone()
+	}
+	t.root.Store(root)
+	for i, topic := range t.unindexed {
+		t.dictionary.release(topic)
+		t.unindexed[i] = ""
+	}
+	t.unindexed = t.unindexed[:0]
+}
+
+// Subscribe adds the Subscriber to the topic and returns a Subscription.
+func (t *rcuTrieMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	topic = canonicalTopic(topic)
+	t.mu.Lock()
+	if t.index.add(topic, sub) {
+		var buf [wordBufferSize]uint32
+		t.publish(t.root.Load().update(t.dictionary.intern(topic, buf[:0]), func(n *rcuNode) *rcuNode {
+			return n.withSub(sub)
+		}))
+		t.registry.acquire(sub)
+		t.watchers.subscribed(topic)
+	}
+	t.mu.Unlock()
+	return &Subscription{topic: topic, subscriber: sub}, nil
+}
+
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (t *rcuTrieMatcher) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return t.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (t *rcuTrieMatcher) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return t.Subscribe(joinFilter(words), sub)
+}
+
+// Unsubscribe removes the Subscription.
+func (t *rcuTrieMatcher) Unsubscribe(sub *Subscription) {
+	t.mu.Lock()
+	t.publish(t.unsubscribe(t.root.Load(), sub.topic, sub.subscriber))
+	t.mu.Unlock()
+}
+
+// UnsubscribeAll removes all Subscriptions for the Subscriber. The new trie
+// is published once every Subscription has been removed.
+func (t *rcuTrieMatcher) UnsubscribeAll(sub Subscriber) {
+	t.mu.Lock()
+	root := t.root.Load()
+	for _, topic := range t.index.topics(sub) {
+		root = t.unsubscribe(root, topic, sub)
+	}
+	t.publish(root)
+	t.mu.Unlock()
+}
+
+// unsubscribe returns a copy of the trie rooted at the node without the
+// Subscriber on the topic. The node is returned as is if there is no such
+// Subscription. The caller must hold the lock.
+func (t *rcuTrieMatcher) unsubscribe(root *rcuNode, topic string, sub Subscriber) *rcuNode {
+	if _, ok := t.index[sub][topic]; !ok {
+		return root
+	}
+	var buf [wordBufferSize]uint32
+	words := t.dictionary.lookup(topic, buf[:0])
+	t.unindex(topic, sub)
+	return root.update(words, func(n *rcuNode) *rcuNode {
+		return n.withoutSub(sub)
+	})
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern.
+func (t *rcuTrieMatcher) UnsubscribeMatching(pattern string) {
+	t.mu.Lock()
+	var buf [wordBufferSize]uint32
+	root := t.root.Load()
+	if updated := t.unsubscribePattern(root, t.dictionary.lookup(pattern, buf[:0]), nil, false); updated != root {
+		t.publish(updated)
+	}
+	t.mu.Unlock()
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix.
+func (t *rcuTrieMatcher) UnsubscribePrefix(prefix string) {
+	t.mu.Lock()
+	var buf [wordBufferSize]uint32
+	root := t.root.Load()
+	if updated := t.unsubscribePattern(root, t.dictionary.lookup(prefix, buf[:0]), nil, true); updated != root {
+		t.publish(updated)
+	}
+	t.mu.Unlock()
+}
+
+// unsubscribePattern returns a copy of the trie rooted at the node without
+// the Subscriptions which are covered by the pattern. If prefix is true,
+// every subtree the pattern leads to is dropped. Otherwise, only the
+// Subscribers at the end of the pattern are removed. Nodes are only copied if
+// something below them was removed, so the node itself is returned if nothing
+// was. The caller must hold the lock.
+func (t *rcuTrieMatcher) unsubscribePattern(n *rcuNode, pattern, path []uint32, prefix bool) *rcuNode {
+	if len(pattern) == 0 {
+		if prefix {
+			t.unindexSubtree(n, path)
+			return nil
+		}
+		if len(n.subs) == 0 {
+			return n
+		}
+		// Words are only released by publish, so the path's words are known.
+		topic, _ := t.dictionary.join(path)
+		for sub, _ := range n.subs {
+			t.unindex(topic, sub)
+		}
+		c := n.clone()
+		c.subs = nil
+		if c.isEmpty() {
+			return nil
+		}
+		return c
+	}
+
+	var c *rcuNode
+	remove := func(word uint32, child *rcuNode) {
+		updated := t.unsubscribePattern(child, pattern[1:], append(path, word), prefix)
+		if updated == child {
+			return
+		}
+		if c == nil {
+			c = n.clone()
+		}
+		if updated != nil {
+			c.children = c.children.with(word, updated)
+		} else {
+			c.children = c.children.without(word)
+		}
+	}
+	if pattern[0] == wildcardID {
+		n.children.each(remove)
+	} else if child := n.children.get(pattern[0]); child != nil {
+		// A literal word only covers its own child.
+		remove(pattern[0], child)
+	}
+	if c == nil {
+		return n
+	}
+	if c.isEmpty() {
+		return nil
+	}
+	return c
+}
+
+// unindexSubtree removes every Subscription in the subtree rooted at the node
+// from the reverse index. The caller must hold the lock.
+func (t *rcuTrieMatcher) unindexSubtree(n *rcuNode, path []uint32) {
+	topic, _ := t.dictionary.join(path)
+	for sub, _ := range n.subs {
+		t.unindex(topic, sub)
+	}
+	n.children.each(func(word uint32, child *rcuNode) {
+		t.unindexSubtree(child, append(path, word))
+	})
+}
+
+// unindex removes the Subscription from the reverse index, notifying Watchers
+// if it was there and releasing the Subscriber's ID once it has no
+// Subscriptions left. The topic's words are released by the next publish.
+// The caller must hold the lock.
+func (t *rcuTrieMatcher) unindex(topic string, sub Subscriber) {
+	if t.index.remove(topic, sub) {
+		t.unindexed = append(t.unindexed, topic)
+		t.watchers.unsubscribed(topic)
+		t.registry.release(sub)
+	}
+}
+
+// Topics returns the topics the Subscriber is subscribed to.
+func (t *rcuTrieMatcher) Topics(sub Subscriber) []string {
+	t.mu.Lock()
+	topics := t.index.topics(sub)
+	t.mu.Unlock()
+	return topics
+}
+
+// Watch returns a Watcher which receives filter-level change Events.
+func (t *rcuTrieMatcher) Watch() *Watcher {
+	return t.watchers.watch()
+}
+
+// Lookup returns the Subscribers for the given topic.
+func (t *rcuTrieMatcher) Lookup(topic string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return t.lookupIDs(t.dictionary.lookup(topic, buf[:0]))
+}
+
+// lookupIDs returns the Subscribers for the topic made of the words with the
+// given IDs.
+func (t *rcuTrieMatcher) lookupIDs(words []uint32) []Subscriber {
+	var (
+		subMap = t.lookup(words, t.root.Load())
+		subs   = make([]Subscriber, len(subMap))
+		i      = 0
+	)
+	for sub, _ := range subMap {
+		subs[i] = sub
+		i++
+	}
+	return subs
+}
+
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (t *rcuTrieMatcher) LookupBytes(topic []byte) []Subscriber {
+	return t.Lookup(bytesToString(topic))
+}
+
+// LookupWords returns the Subscribers for the topic made of the words.
+func (t *rcuTrieMatcher) LookupWords(words []string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return t.lookupIDs(t.dictionary.lookupWords(words, buf[:0]))
+}
+
+// LookupBitmap returns the IDs of the Subscribers for the given topic.
+func (t *rcuTrieMatcher) LookupBitmap(topic string) *roaring.Bitmap {
+	var buf [wordBufferSize]uint32
+	return t.registry.bitmap(t.lookup(t.dictionary.lookup(topic, buf[:0]), t.root.Load()))
+}
+
+// Registry returns the SubscriberRegistry which assigns Subscriber IDs.
+func (t *rcuTrieMatcher) Registry() *SubscriberRegistry {
+	return t.registry
+}
+
+// lookup returns the Subscribers below the node for the topic word IDs. Since
+// nodes are immutable, the returned set may be a node's own.
+func (t *rcuTrieMatcher) lookup(words []uint32, node *rcuNode) map[Subscriber]struct{} {
+	if len(words) == 0 {
+		return node.subs
+	}
+	subs := make(map[Subscriber]struct{})
+	if n := node.children.get(words[0]); n != nil {
+		for k, v := range t.lookup(words[1:], n) {
+			subs[k] = v
+		}
+	}
+	if n := node.children.get(wildcardID); n != nil {
+		for k, v := range t.lookup(words[1:], n) {
+			subs[k] = v
+		}
+	}
+	return subs
+}
+
+// LookupPattern returns the Subscribers whose topic overlaps the filter.
+func (t *rcuTrieMatcher) LookupPattern(filter string) []Subscriber {
+	var (
+		buf    [wordBufferSize]uint32
+		subMap = make(map[Subscriber]struct{})
+	)
+	t.lookupPattern(t.dictionary.lookup(filter, buf[:0]), t.root.Load(), subMap)
+	var (
+		subs = make([]Subscriber, len(subMap))
+		i    = 0
+	)
+	for sub, _ := range subMap {
+		subs[i] = sub
+		i++
+	}
+	return subs
+}
+
+// lookupPattern adds the Subscribers below the node whose topics overlap the
+// filter word IDs to subs. Every child is followed where the filter has a
+// wildcard.
+func (t *rcuTrieMatcher) lookupPattern(words []uint32, node *rcuNode, subs map[Subscriber]struct{}) {
+	if len(words) == 0 {
+		for sub, _ := range node.subs {
+			subs[sub] = struct{}{}
+		}
+		return
+	}
+	if words[0] == wildcardID {
+		node.children.each(func(_ uint32, child *rcuNode) {
+			t.lookupPattern(words[1:], child, subs)
+		})
+		return
+	}
+	if n := node.children.get(words[0]); n != nil {
+		t.lookupPattern(words[1:], n, subs)
+	}
+	if n := node.children.get(wildcardID); n != nil {
+		t.lookupPattern(words[1:], n, subs)
+	}
+}
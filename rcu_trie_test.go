@@ -0,0 +1,287 @@
+package matching
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRCUTrieMatcher(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		m  = NewRCUTrieMatcher()
+		s0 = 0
+		s1 = 1
+		s2 = 2
+	)
+
+	sub0, err := m.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	sub1, err := m.Subscribe("*.usd", s0)
+	assert.NoError(err)
+	sub2, err := m.Subscribe("forex.eur", s0)
+	assert.NoError(err)
+	sub3, err := m.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	sub4, err := m.Subscribe("forex.*", s1)
+	assert.NoError(err)
+	sub5, err := m.Subscribe("trade", s1)
+	assert.NoError(err)
+	sub6, err := m.Subscribe("*", s2)
+	assert.NoError(err)
+
+	assertEqual(assert, []Subscriber{s0, s1}, m.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s2}, m.Lookup("forex"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade.jpy"))
+	assertEqual(assert, []Subscriber{s0, s1}, m.Lookup("forex.jpy"))
+	assertEqual(assert, []Subscriber{s1, s2}, m.Lookup("trade"))
+
+	m.Unsubscribe(sub0)
+	m.Unsubscribe(sub1)
+	m.Unsubscribe(sub2)
+	m.Unsubscribe(sub3)
+	m.Unsubscribe(sub4)
+	m.Unsubscribe(sub5)
+	m.Unsubscribe(sub6)
+
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade.jpy"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.jpy"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade"))
+}
+
+// Ensures pattern removals which remove nothing keep the published trie.
+func TestRCUTrieMatcherUnsubscribePatternUnchanged(t *testing.T) {
+	assert := assert.New(t)
+	m := NewRCUTrieMatcher().(*rcuTrieMatcher)
+	_, err := m.Subscribe("forex.eur.bid", 0)
+	assert.NoError(err)
+	_, err = m.Subscribe("trade.*", 1)
+	assert.NoError(err)
+
+	root := m.root.Load()
+	m.UnsubscribeMatching("forex.*")
+	m.UnsubscribeMatching("forex.usd.bid")
+	m.UnsubscribeMatching("unseen.*.bid")
+	m.UnsubscribePrefix("forex.usd")
+	assert.True(root == m.root.Load())
+
+	m.UnsubscribeMatching("trade.eur")
+	assert.True(root == m.root.Load())
+	m.UnsubscribeMatching("*.*")
+	assert.False(root == m.root.Load())
+	assert.Equal([]Subscriber{0}, m.Lookup("forex.eur.bid"))
+	assert.Len(m.Lookup("trade.eur"), 0)
+}
+
+func TestRCUTrieMatcherConcurrentReaders(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		m    = NewRCUTrieMatcher()
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	_, err := m.Subscribe("forex.eur", "base")
+	assert.NoError(err)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Every published trie has the base subscription.
+				assert.Contains(m.Lookup("forex.eur"), "base")
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		sub, err := m.Subscribe("forex.*", i)
+		assert.NoError(err)
+		m.Unsubscribe(sub)
+	}
+	close(done)
+	wg.Wait()
+	assertEqual(assert, []Subscriber{"base"}, m.Lookup("forex.eur"))
+}
+
+func BenchmarkRCUTrieMatcherSubscribe(b *testing.B) {
+	var (
+		m  = NewRCUTrieMatcher()
+		s0 = 0
+	)
+	populateMatcher(m, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Subscribe("foo.*.baz.qux.quux", s0)
+	}
+}
+
+func BenchmarkRCUTrieMatcherUnsubscribe(b *testing.B) {
+	var (
+		m  = NewRCUTrieMatcher()
+		s0 = 0
+	)
+	id, _ := m.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(m, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Unsubscribe(id)
+	}
+}
+
+func BenchmarkRCUTrieMatcherLookup(b *testing.B) {
+	var (
+		m  = NewRCUTrieMatcher()
+		s0 = 0
+	)
+	m.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(m, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Lookup("foo.bar.baz.qux.quux")
+	}
+}
+
+func BenchmarkRCUTrieMatcherSubscribeCold(b *testing.B) {
+	var (
+		m  = NewRCUTrieMatcher()
+		s0 = 0
+	)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Subscribe("foo.*.baz.qux.quux", s0)
+	}
+}
+
+func BenchmarkRCUTrieMatcherUnsubscribeCold(b *testing.B) {
+	var (
+		m  = NewRCUTrieMatcher()
+		s0 = 0
+	)
+	id, _ := m.Subscribe("foo.*.baz.qux.quux", s0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Unsubscribe(id)
+	}
+}
+
+func BenchmarkRCUTrieMatcherLookupCold(b *testing.B) {
+	var (
+		m  = NewRCUTrieMatcher()
+		s0 = 0
+	)
+	m.Subscribe("foo.*.baz.qux.quux", s0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Lookup("foo.bar.baz.qux.quux")
+	}
+}
+
+func BenchmarkMultithreaded1Thread5050RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 1
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded2Thread5050RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 2
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded4Thread5050RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded8Thread5050RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 8
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded12Thread5050RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 12
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded16Thread5050RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 16
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded1Thread9010RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 1
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded2Thread9010RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 2
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded4Thread9010RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded8Thread9010RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 8
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded12Thread9010RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 12
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded16Thread9010RCUTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 16
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return NewRCUTrieMatcher()
+	})
+}
@@ -0,0 +1,162 @@
+package matching
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// SubscriberRegistry assigns each subscribed Subscriber a uint32 ID so that
+// sets of Subscribers can be represented as bitmaps. Matchers hold a
+// Subscriber's ID while it has Subscriptions and forget it once the last one
+// is removed. IDs are never reused, so an ID held past then resolves to no
+// Subscriber rather than to a different one, and a Subscriber which
+// subscribes again is assigned a new ID. At most 2^32 IDs can be assigned
+// over the registry's lifetime. It is safe for concurrent use.
+type SubscriberRegistry struct {
+	ids         map[Subscriber]*registryEntry
+	subscribers map[uint32]Subscriber
+	next        uint64
+	mu          sync.RWMutex
+}
+
+// registryEntry is the ID of a Subscriber and the number of references
+// matchers hold on it. An entry whose references drop to zero is never
+// revived, so once released it can be forgotten without racing acquire.
+type registryEntry struct {
+	id   uint32
+	refs atomic.Int64
+}
+
+// NewSubscriberRegistry returns an empty SubscriberRegistry.
+func NewSubscriberRegistry() *SubscriberRegistry {
+	return &SubscriberRegistry{
+		ids:         make(map[Subscriber]*registryEntry),
+		subscribers: make(map[uint32]Subscriber),
+	}
+}
+
+// ID returns the ID of the Subscriber. False is returned if it has none,
+// meaning it isn't subscribed.
+func (r *SubscriberRegistry) ID(sub Subscriber) (uint32, bool) {
+	r.mu.RLock()
+	e, ok := r.ids[sub]
+	r.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	return e.id, true
+}
+
+// acquire takes a reference on the Subscriber's ID and returns it, assigning
+// one if it has none. Subscribers which already have an ID only take the
+// read lock. It panics if every uint32 has been assigned.
+func (r *SubscriberRegistry) acquire(sub Subscriber) uint32 {
+	r.mu.RLock()
+	e, ok := r.ids[sub]
+	r.mu.RUnlock()
+	if ok && e.tryAcquire() {
+		return e.id
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.ids[sub]; ok && e.tryAcquire() {
+		return e.id
+	}
+	// Any entry left is being released, so it is replaced by a new one.
+	if r.next > math.MaxUint32 {
+		panic("matching: SubscriberRegistry has no IDs left")
+	}
+	e = &registryEntry{id: uint32(r.next)}
+	e.refs.Store(1)
+	r.next++
+	r.ids[sub] = e
+	r.subscribers[e.id] = sub
+	return e.id
+}
+
+// tryAcquire takes a reference on the entry unless it has been released.
+func (e *registryEntry) tryAcquire() bool {
+	for {
+		refs := e.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if e.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release gives back a reference acquire took on the Subscriber's ID,
+// forgetting the ID once no references are left.
+func (r *SubscriberRegistry) release(sub Subscriber) {
+	r.mu.RLock()
+	e, ok := r.ids[sub]
+	r.mu.RUnlock()
+	if !ok || e.refs.Add(-1) != 0 {
+		return
+	}
+
+	r.mu.Lock()
+	// The Subscriber may already have been assigned a new ID.
+	if r.ids[sub] == e {
+		delete(r.ids, sub)
+	}
+	delete(r.subscribers, e.id)
+	r.mu.Unlock()
+}
+
+// Subscriber returns the Subscriber with the ID. False is returned if no
+// Subscriber holds the ID.
+func (r *SubscriberRegistry) Subscriber(id uint32) (Subscriber, bool) {
+	r.mu.RLock()
+	sub, ok := r.subscribers[id]
+	r.mu.RUnlock()
+	return sub, ok
+}
+
+// Bitmap returns a bitmap of the IDs of the Subscribers. Subscribers without
+// an ID are skipped.
+func (r *SubscriberRegistry) Bitmap(subs []Subscriber) *roaring.Bitmap {
+	bitmap := roaring.New()
+	r.mu.RLock()
+	for _, sub := range subs {
+		if e, ok := r.ids[sub]; ok {
+			bitmap.Add(e.id)
+		}
+	}
+	r.mu.RUnlock()
+	return bitmap
+}
+
+// Subscribers returns the Subscribers with the IDs in the bitmap. IDs which
+// no Subscriber holds are skipped.
+func (r *SubscriberRegistry) Subscribers(bitmap *roaring.Bitmap) []Subscriber {
+	subs := make([]Subscriber, 0, bitmap.GetCardinality())
+	r.mu.RLock()
+	for iter := bitmap.Iterator(); iter.HasNext(); {
+		if sub, ok := r.subscribers[iter.Next()]; ok {
+			subs = append(subs, sub)
+		}
+	}
+	r.mu.RUnlock()
+	return subs
+}
+
+// bitmap returns a bitmap of the IDs of the Subscribers in the set, skipping
+// those without an ID.
+func (r *SubscriberRegistry) bitmap(set map[Subscriber]struct{}) *roaring.Bitmap {
+	bitmap := roaring.New()
+	r.mu.RLock()
+	for sub, _ := range set {
+		if e, ok := r.ids[sub]; ok {
+			bitmap.Add(e.id)
+		}
+	}
+	r.mu.RUnlock()
+	return bitmap
+}
@@ -0,0 +1,64 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriberRegistry(t *testing.T) {
+	assert := assert.New(t)
+	r := NewSubscriberRegistry()
+
+	assert.Equal(uint32(0), r.acquire("a"))
+	assert.Equal(uint32(1), r.acquire("b"))
+	assert.Equal(uint32(0), r.acquire("a"))
+
+	id, ok := r.ID("b")
+	assert.True(ok)
+	assert.Equal(uint32(1), id)
+	_, ok = r.ID("c")
+	assert.False(ok)
+
+	sub, ok := r.Subscriber(1)
+	assert.True(ok)
+	assert.Equal("b", sub)
+	_, ok = r.Subscriber(2)
+	assert.False(ok)
+
+	// Subscribers without an ID are skipped rather than assigned one.
+	bitmap := r.Bitmap([]Subscriber{"b", "c"})
+	assert.Equal([]uint32{1}, bitmap.ToArray())
+	_, ok = r.ID("c")
+	assert.False(ok)
+	bitmap.Add(7)
+	assertEqual(assert, []Subscriber{"b"}, r.Subscribers(bitmap))
+}
+
+func TestSubscriberRegistryRelease(t *testing.T) {
+	assert := assert.New(t)
+	r := NewSubscriberRegistry()
+
+	assert.Equal(uint32(0), r.acquire("a"))
+	assert.Equal(uint32(0), r.acquire("a"))
+	assert.Equal(uint32(1), r.acquire("b"))
+	stale := r.Bitmap([]Subscriber{"a", "b"})
+
+	// The ID is kept until every reference is released.
+	r.release("a")
+	sub, ok := r.Subscriber(0)
+	assert.True(ok)
+	assert.Equal("a", sub)
+	r.release("a")
+	_, ok = r.Subscriber(0)
+	assert.False(ok)
+	_, ok = r.ID("a")
+	assert.False(ok)
+	r.release("c")
+
+	// IDs aren't reused, so bitmaps held past a release don't resolve to
+	// other Subscribers.
+	assert.Equal(uint32(2), r.acquire("c"))
+	assert.Equal(uint32(3), r.acquire("a"))
+	assertEqual(assert, []Subscriber{"b"}, r.Subscribers(stale))
+}
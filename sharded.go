@@ -0,0 +1,245 @@
+package matching
+
+import "sync"
+
+// shardedMatcher spreads Subscriptions over several inner Matchers so that
+// writers to unrelated topics don't contend. Filters are routed by a hash of
+// their first word, while filters starting with a wildcard go to a dedicated
+// shard which is consulted by every Lookup. A Lookup therefore merges the
+// results of at most two shards.
+type shardedMatcher struct {
+	shards   []Matcher
+	wildcard Matcher
+
+	watchers *watchers
+
+	// The shard Watchers and their forwarding goroutines only run while
+	// there are outer Watchers, which watching counts.
+	watching   int
+	forwarders []*Watcher
+	forwarding sync.WaitGroup
+	watchMu    sync.Mutex
+}
+
+// NewShardedMatcher returns a Matcher which spreads Subscriptions over n
+// shards, plus the shard for leading-wildcard filters, each created by calling
+// factory. Writers to topics in different shards don't contend.
+func NewShardedMatcher(n int, factory func() Matcher) Matcher {
+	if n < 1 {
+		n = 1
+	}
+	shards := make([]Matcher, n)
+	for i := range shards {
+		shards[i] = factory()
+	}
+	return &shardedMatcher{
+		shards:   shards,
+		wildcard: factory(),
+		watchers: newWatchers(),
+	}
+}
+
+// firstWord returns the first word of the topic.
+func firstWord(topic string) string {
+	words := newTokenizer(topic)
+	word, _ := words.next()
+	return word
+}
+
+// shard returns the shard which holds filters with the given first word.
+func (s *shardedMatcher) shard(word string) Matcher {
+	if word == wildcard {
+		return s.wildcard
+	}
+	// FNV-1a, inlined to avoid allocating.
+	h := uint32(2166136261)
+	for i := 0; i < len(word); i++ {
+		h ^= uint32(word[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+// all returns every shard, including the leading-wildcard shard.
+func (s *shardedMatcher) all() []Matcher {
+	return append([]Matcher{s.wildcard}, s.shards...)
+}
+
+// Subscribe adds the Subscriber to the topic and returns a Subscription.
+func (s *shardedMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	return s.shard(firstWord(topic)).Subscribe(topic, sub)
+}
+
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (s *shardedMatcher) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return s.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (s *shardedMatcher) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return s.Subscribe(joinFilter(words), sub)
+}
+
+// Unsubscribe removes the Subscription.
+func (s *shardedMatcher) Unsubscribe(sub *Subscription) {
+	s.shard(firstWord(sub.topic)).Unsubscribe(sub)
+}
+
+// UnsubscribeAll removes all Subscriptions for the Subscriber from every
+// shard.
+func (s *shardedMatcher) UnsubscribeAll(sub Subscriber) {
+	for _, shard := range s.all() {
+		shard.UnsubscribeAll(sub)
+	}
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern. Only a pattern starting with a wildcard reaches every shard.
+func (s *shardedMatcher) UnsubscribeMatching(pattern string) {
+	for _, shard := range s.covering(pattern) {
+		shard.UnsubscribeMatching(pattern)
+	}
+}
+
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix. Only a prefix starting with a wildcard reaches every
+// shard.
+func (s *shardedMatcher) UnsubscribePrefix(prefix string) {
+	for _, shard := range s.covering(prefix) {
+		shard.UnsubscribePrefix(prefix)
+	}
+}
+
+// covering returns the shards which may hold filters covered by the pattern.
+// A literal first word only covers filters with the same first word.
+func (s *shardedMatcher) covering(pattern string) []Matcher {
+	if word := firstWord(pattern); word != wildcard {
+		return []Matcher{s.shard(word)}
+	}
+	return s.all()
+}
+
+// Topics returns the topics the Subscriber is subscribed to. Since each
+// filter lives in exactly one shard, the shards' topics are disjoint.
+func (s *shardedMatcher) Topics(sub Subscriber) []string {
+	topics := []string{}
+	for _, shard := range s.all() {
+		topics = append(topics, shard.Topics(sub)...)
+	}
+	return topics
+}
+
+// Lookup returns the Subscribers for the given topic by merging the results
+// of the topic's shard and the leading-wildcard shard.
+func (s *shardedMatcher) Lookup(topic string) []Subscriber {
+	return merge(
+		s.shard(firstWord(topic)).Lookup(topic),
+		s.wildcard.Lookup(topic),
+	)
+}
+
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (s *shardedMatcher) LookupBytes(topic []byte) []Subscriber {
+	return s.Lookup(bytesToString(topic))
+}
+
+// LookupWords returns the Subscribers for the topic made of the words.
+func (s *shardedMatcher) LookupWords(words []string) []Subscriber {
+	first := empty
+	if len(words) > 0 {
+		first = EscapeWord(words[0])
+	}
+	return merge(
+		s.shard(first).LookupWords(words),
+		s.wildcard.LookupWords(words),
+	)
+}
+
+// LookupPattern returns the Subscribers whose topic overlaps the filter. A
+// filter starting with a wildcard overlaps filters in every shard.
+func (s *shardedMatcher) LookupPattern(filter string) []Subscriber {
+	var shards []Matcher
+	if word := firstWord(filter); word != wildcard {
+		shards = []Matcher{s.shard(word), s.wildcard}
+	} else {
+		shards = s.all()
+	}
+	results := make([][]Subscriber, len(shards))
+	for i, shard := range shards {
+		results[i] = shard.LookupPattern(filter)
+	}
+	return merge(results...)
+}
+
+// merge returns the distinct Subscribers in the results.
+func merge(results ...[]Subscriber) []Subscriber {
+	subscriberSet := make(map[Subscriber]struct{})
+	for _, result := range results {
+		for _, sub := range result {
+			subscriberSet[sub] = struct{}{}
+		}
+	}
+	subscribers := make([]Subscriber, 0, len(subscriberSet))
+	for sub, _ := range subscriberSet {
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers
+}
+
+// Watch returns a Watcher which receives filter-level change Events for
+// every shard. Since each filter lives in exactly one shard, the shards'
+// Events are merged into a single change stream, and Seq numbers the merged
+// stream rather than any one shard's, so it increases across shards. While any Watcher returned
+// by Watch is open, a goroutine per shard forwards its Events, so Events may
+// arrive slightly after the change is made. Closing the last Watcher closes
+// the shard Watchers and stops the goroutines.
+func (s *shardedMatcher) Watch() *Watcher {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if s.watching == 0 {
+		for _, shard := range s.all() {
+			w := shard.Watch()
+			s.forwarders = append(s.forwarders, w)
+			s.forwarding.Add(1)
+			go s.forwardEvents(w)
+		}
+	}
+	s.watching++
+	w := s.watchers.watch()
+	w.onClose = s.unwatch
+	return w
+}
+
+// unwatch stops forwarding the shards' Events once the last Watcher is
+// closed. The Subscription counts are rebuilt from the shard Watchers' initial
+// Events when forwarding starts again.
+func (s *shardedMatcher) unwatch() {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	s.watching--
+	if s.watching > 0 {
+		return
+	}
+	for _, w := range s.forwarders {
+		w.Close()
+	}
+	s.forwarding.Wait()
+	s.forwarders = nil
+	s.watchers.reset()
+}
+
+// forwardEvents applies the shard Watcher's Events to the shardedMatcher's
+// Watchers until the shard Watcher is closed.
+func (s *shardedMatcher) forwardEvents(w *Watcher) {
+	defer s.forwarding.Done()
+	for e := range w.Events() {
+		if e.Type == FilterAdded {
+			s.watchers.subscribed(e.Filter)
+		} else {
+			s.watchers.unsubscribed(e.Filter)
+		}
+	}
+}
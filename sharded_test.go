@@ -0,0 +1,159 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newShardedTrieMatcher() Matcher {
+	return NewShardedMatcher(4, NewTrieMatcher)
+}
+
+func TestShardedMatcher(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		m  = NewShardedMatcher(4, NewTrieMatcher).(*shardedMatcher)
+		s0 = 0
+		s1 = 1
+		s2 = 2
+	)
+
+	sub0, err := m.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	sub1, err := m.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	sub2, err := m.Subscribe("trade", s2)
+	assert.NoError(err)
+
+	// Leading-wildcard filters live in their own shard.
+	assertEqual(assert, []Subscriber{s1}, m.wildcard.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s0}, m.shard("forex").Lookup("forex.eur"))
+
+	assertEqual(assert, []Subscriber{s0, s1}, m.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{s1}, m.Lookup("trade.eur"))
+	assertEqual(assert, []Subscriber{s2}, m.Lookup("trade"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex"))
+
+	m.Unsubscribe(sub0)
+	m.Unsubscribe(sub1)
+	m.Unsubscribe(sub2)
+
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade"))
+}
+
+// Ensures Events from different shards are numbered by a single sequence.
+func TestShardedMatcherWatchSeq(t *testing.T) {
+	assert := assert.New(t)
+	m := NewShardedMatcher(4, NewTrieMatcher)
+	w := m.Watch()
+	defer w.Close()
+
+	filters := []string{"a.b", "*.c", "d", "e.*", "f.g", "*"}
+	for i, filter := range filters {
+		_, err := m.Subscribe(filter, i)
+		assert.NoError(err)
+		// Wait for each Event so that the shards' forwarders can't reorder
+		// them.
+		assert.Equal(Event{Type: FilterAdded, Filter: filter, Seq: uint64(i + 1)}, nextEvent(assert, w))
+	}
+	for i, filter := range filters {
+		m.UnsubscribeAll(i)
+		seq := uint64(len(filters) + i + 1)
+		assert.Equal(Event{Type: FilterRemoved, Filter: filter, Seq: seq}, nextEvent(assert, w))
+	}
+}
+
+// Ensures the shard Watchers only run while the ShardedMatcher is watched.
+func TestShardedMatcherWatchClose(t *testing.T) {
+	assert := assert.New(t)
+	m := NewShardedMatcher(4, NewTrieMatcher).(*shardedMatcher)
+	shardWatchers := func() int {
+		n := 0
+		for _, shard := range m.all() {
+			hub := shard.(*trieMatcher).watchers
+			hub.mu.Lock()
+			n += len(hub.watchers)
+			hub.mu.Unlock()
+		}
+		return n
+	}
+	_, err := m.Subscribe("a.b", 0)
+	assert.NoError(err)
+
+	w0 := m.Watch()
+	w1 := m.Watch()
+	assert.Equal(5, shardWatchers())
+	assert.Equal(Event{Type: FilterAdded, Filter: "a.b", Seq: 1}, nextEvent(assert, w0))
+	assert.Equal(Event{Type: FilterAdded, Filter: "a.b", Seq: 1}, nextEvent(assert, w1))
+
+	w0.Close()
+	w0.Close()
+	assert.Equal(5, shardWatchers())
+	w1.Close()
+	assert.Equal(0, shardWatchers())
+	assert.Len(m.forwarders, 0)
+
+	// Watching again starts from the current filters.
+	_, err = m.Subscribe("*.c", 1)
+	assert.NoError(err)
+	w := m.Watch()
+	defer w.Close()
+	var filters []string
+	for seq := uint64(2); seq <= 3; seq++ {
+		e := nextEvent(assert, w)
+		assert.Equal(FilterAdded, e.Type)
+		assert.Equal(seq, e.Seq)
+		filters = append(filters, e.Filter)
+	}
+	assert.ElementsMatch([]string{"a.b", "*.c"}, filters)
+	m.UnsubscribeAll(0)
+	assert.Equal(Event{Type: FilterRemoved, Filter: "a.b", Seq: 4}, nextEvent(assert, w))
+}
+
+func BenchmarkShardedMatcherLookup(b *testing.B) {
+	var (
+		m  = newShardedTrieMatcher()
+		s0 = 0
+	)
+	m.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(m, 1000, 5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Lookup("foo.bar.baz.qux.quux")
+	}
+}
+
+func BenchmarkMultithreaded4Thread5050ShardedTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return newShardedTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded16Thread5050ShardedTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 16
+	benchmark5050(b, numItems, numThreads, func(items [][]string) Matcher {
+		return newShardedTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded4Thread9010ShardedTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 4
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return newShardedTrieMatcher()
+	})
+}
+
+func BenchmarkMultithreaded16Thread9010ShardedTrie(b *testing.B) {
+	numItems := 1000
+	numThreads := 16
+	benchmark9010(b, numItems, numThreads, func(items [][]string) Matcher {
+		return newShardedTrieMatcher()
+	})
+}
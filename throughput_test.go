@@ -41,8 +41,13 @@ func TestThroughput(t *testing.T) {
 	testThroughput(t, NewNaiveMatcher(), "naive")
 	testThroughput(t, NewInvertedBitmapMatcher(msgs), "inverted bitmap")
 	testThroughput(t, NewOptimizedInvertedBitmapMatcher(3), "optimized inverted bitmap")
+	testThroughput(t, NewInvertedBitmapMatcher64(msgs), "inverted bitmap 64")
+	testThroughput(t, NewOptimizedInvertedBitmapMatcher64(3), "optimized inverted bitmap 64")
 	testThroughput(t, NewTrieMatcher(), "trie")
 	testThroughput(t, NewCSTrieMatcher(), "cs-trie")
+	testThroughput(t, NewRCUTrieMatcher(), "rcu-trie")
+	testThroughput(t, NewLockingTrieMatcher(), "locking trie")
+	testThroughput(t, NewShardedMatcher(4, NewTrieMatcher), "sharded trie")
 }
 
 func testThroughput(t *testing.T, m Matcher, name string) {
@@ -73,6 +78,14 @@ func BenchmarkPopulateOptimizedInvertedBitmap(b *testing.B) {
 	benchmarkPopulate(b, NewOptimizedInvertedBitmapMatcher(3))
 }
 
+func BenchmarkPopulateInvertedBitmap64(b *testing.B) {
+	benchmarkPopulate(b, NewInvertedBitmapMatcher64(msgs))
+}
+
+func BenchmarkPopulateOptimizedInvertedBitmap64(b *testing.B) {
+	benchmarkPopulate(b, NewOptimizedInvertedBitmapMatcher64(3))
+}
+
 func BenchmarkPopulateTrie(b *testing.B) {
 	benchmarkPopulate(b, NewTrieMatcher())
 }
@@ -81,6 +94,14 @@ func BenchmarkPopulateCSTrie(b *testing.B) {
 	benchmarkPopulate(b, NewCSTrieMatcher())
 }
 
+func BenchmarkPopulateRCUTrie(b *testing.B) {
+	benchmarkPopulate(b, NewRCUTrieMatcher())
+}
+
+func BenchmarkPopulateLockingTrie(b *testing.B) {
+	benchmarkPopulate(b, NewLockingTrieMatcher())
+}
+
 func benchmarkPopulate(b *testing.B, m Matcher) {
 	b.ReportAllocs()
 	b.ResetTimer()
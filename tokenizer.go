@@ -0,0 +1,163 @@
+package matching
+
+import (
+	"strings"
+	"unsafe"
+)
+
+var (
+	// wordEscaper escapes a word so that it can be joined into a topic. An
+	// escaped delimiter is part of its word rather than the end of it.
+	wordEscaper = strings.NewReplacer(escape, escape+escape, delimiter, escape+delimiter)
+
+	// wordUnescaper reverses wordEscaper and the escaping of a literal
+	// wildcard word. An escape before any other character stands for itself.
+	wordUnescaper = strings.NewReplacer(
+		escape+escape, escape,
+		escape+delimiter, delimiter,
+		escape+wildcard, wildcard,
+	)
+)
+
+// tokenizer iterates over the words of a topic without allocating. Words are
+// returned in their canonical escaped form, so two words are equal exactly
+// when they're spelled the same once unescaped. Unless a word is escaped
+// differently, it's a substring of the topic, so it's only as long-lived as
+// the topic itself.
+type tokenizer struct {
+	rest string
+	done bool
+}
+
+func newTokenizer(topic string) tokenizer {
+	return tokenizer{rest: topic}
+}
+
+// next returns the next word of the topic and true, or false once every word
+// has been returned. Every topic, even the empty one, has at least one word.
+func (t *tokenizer) next() (string, bool) {
+	if t.done {
+		return empty, false
+	}
+	// The delimiter and escape are single bytes, so a byte scan finds
+	// whichever comes first.
+	for i := 0; i < len(t.rest); i++ {
+		switch t.rest[i] {
+		case delimiter[0]:
+			return t.advance(i), true
+		case escape[0]:
+			return t.nextEscaped(), true
+		}
+	}
+	return t.advance(len(t.rest)), true
+}
+
+// nextEscaped returns the next word of the topic, which is escaped. Its
+// delimiter may be too.
+func (t *tokenizer) nextEscaped() string {
+	return canonicalWord(t.advance(escapedWordEnd(t.rest)))
+}
+
+// advance returns the word ending at the index and moves past it and the
+// delimiter following it, if any.
+func (t *tokenizer) advance(end int) string {
+	word := t.rest[:end]
+	if end == len(t.rest) {
+		t.done = true
+	} else {
+		t.rest = t.rest[end+len(delimiter):]
+	}
+	return word
+}
+
+// escapedWordEnd returns the index of the first unescaped delimiter in the
+// topic, or its length if there is none.
+func escapedWordEnd(topic string) int {
+	for i := 0; i < len(topic); i++ {
+		switch topic[i] {
+		case escape[0]:
+			// Skip the escaped byte.
+			i++
+		case delimiter[0]:
+			return i
+		}
+	}
+	return len(topic)
+}
+
+// canonicalWord returns the word with only the characters which must be
+// escaped escaped, and each of them escaped once.
+func canonicalWord(word string) string {
+	if !strings.Contains(word, escape) {
+		return word
+	}
+	return EscapeWord(wordUnescaper.Replace(word))
+}
+
+// canonicalTopic returns the topic with each of its words in canonical form,
+// so that each filter is stored under a single spelling.
+func canonicalTopic(topic string) string {
+	if !strings.Contains(topic, escape) {
+		return topic
+	}
+	var (
+		canonical strings.Builder
+		words     = newTokenizer(topic)
+	)
+	canonical.Grow(len(topic))
+	for i := 0; ; i++ {
+		word, ok := words.next()
+		if !ok {
+			return canonical.String()
+		}
+		if i > 0 {
+			canonical.WriteString(delimiter)
+		}
+		canonical.WriteString(word)
+	}
+}
+
+// EscapeWord escapes the word so that a topic matches it literally. The
+// escape and delimiter are escaped wherever they appear, and a word which is
+// just the wildcard is escaped to match a literal "*" rather than any word.
+// Words which need no escaping are returned as they are.
+func EscapeWord(word string) string {
+	if word == wildcard {
+		return escape + wildcard
+	}
+	if !strings.Contains(word, escape) && !strings.Contains(word, delimiter) {
+		return word
+	}
+	return wordEscaper.Replace(word)
+}
+
+// JoinWords returns the topic made of the words, escaping each of them with
+// EscapeWord so that it's matched literally. A filter with wildcards can be
+// built by joining the escaped words and wildcards with the delimiter, e.g.
+// JoinWords("files", "report.pdf") + ".*".
+func JoinWords(words ...string) string {
+	escaped := make([]string, len(words))
+	for i, word := range words {
+		escaped[i] = EscapeWord(word)
+	}
+	return strings.Join(escaped, delimiter)
+}
+
+// joinFilter is like JoinWords but leaves wildcard words as wildcards.
+func joinFilter(words []string) string {
+	escaped := make([]string, len(words))
+	for i, word := range words {
+		if word != wildcard {
+			word = EscapeWord(word)
+		}
+		escaped[i] = word
+	}
+	return strings.Join(escaped, delimiter)
+}
+
+// bytesToString returns the bytes as a string without copying them. The
+// string aliases the bytes, so it must not be retained past the call it's
+// passed to.
+func bytesToString(b []byte) string {
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
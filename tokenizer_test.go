@@ -0,0 +1,67 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenizer(t *testing.T) {
+	assert := assert.New(t)
+	tokens := func(topic string) []string {
+		words := []string{}
+		tz := newTokenizer(topic)
+		for word, ok := tz.next(); ok; word, ok = tz.next() {
+			words = append(words, word)
+		}
+		return words
+	}
+
+	assert.Equal([]string{"forex", "eur", "usd"}, tokens("forex.eur.usd"))
+	assert.Equal([]string{"forex", wildcard}, tokens("forex.*"))
+	assert.Equal([]string{empty}, tokens(empty))
+	assert.Equal([]string{empty, empty}, tokens(delimiter))
+	assert.Equal([]string{"a", empty, "c", empty}, tokens("a..c."))
+
+	// Words are returned in canonical escaped form.
+	assert.Equal([]string{`a\.b`, "c"}, tokens(`a\.b.c`))
+	assert.Equal([]string{`c:\\tmp`, `x\.`}, tokens(`c:\\tmp.x\.`))
+	assert.Equal([]string{`c:\\tmp`}, tokens(`c:\tmp`))
+	assert.Equal([]string{`a\\`}, tokens(`a\`))
+	assert.Equal([]string{`\.`, empty}, tokens(`\..`))
+	assert.Equal([]string{"a", `\*`}, tokens(`a.\*`))
+	assert.Equal([]string{"a*b", `\*`}, tokens(`a\*b.\*`))
+}
+
+func TestJoinWords(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("forex.eur", JoinWords("forex", "eur"))
+	assert.Equal(`files.report\.pdf`, JoinWords("files", "report.pdf"))
+	assert.Equal(`c:\\tmp.\*`, JoinWords(`c:\tmp`, wildcard))
+	assert.Equal("a*b.**", JoinWords("a*b", "**"))
+	assert.Equal(empty, JoinWords())
+
+	assert.Equal(`c:\\tmp.*`, joinFilter([]string{`c:\tmp`, wildcard}))
+	assert.Equal(empty, joinFilter(nil))
+
+	assert.Equal("forex.eur", canonicalTopic("forex.eur"))
+	assert.Equal(`c:\\tmp.a\.b`, canonicalTopic(`c:\tmp.a\.b`))
+}
+
+func TestTokenizerAllocs(t *testing.T) {
+	assert := assert.New(t)
+	d := newWordDictionary()
+	d.intern("forex.eur.usd", nil)
+	words := []string{"forex", "eur", "usd"}
+
+	assert.Zero(testing.AllocsPerRun(100, func() {
+		topicMatches("forex.*.usd", "forex.eur.usd")
+		covers("forex.*", "forex.eur")
+		coversPrefix("forex", "forex.eur.usd")
+		Overlaps("forex.*.usd", "*.eur.*")
+		var buf [wordBufferSize]uint32
+		d.lookup("forex.eur.usd", buf[:0])
+		d.intern("forex.eur.usd", buf[:0])
+		d.lookupWords(words, buf[:0])
+	}))
+}
@@ -1,15 +1,17 @@
 package matching
 
 import (
-	"strings"
 	"sync"
+
+	"github.com/RoaringBitmap/roaring"
 )
 
+// node is a trie node. Children are keyed by the dictionary ID of their word.
 type node struct {
-	word     string
+	id       uint32
 	subs     map[Subscriber]struct{}
 	parent   *node
-	children map[string]*node
+	children map[uint32]*node
 }
 
 func (n *node) orphan() {
@@ -17,73 +19,224 @@ func (n *node) orphan() {
 		// Root
 		return
 	}
-	delete(n.parent.children, n.word)
+	delete(n.parent.children, n.id)
 	if len(n.parent.subs) == 0 && len(n.parent.children) == 0 {
 		n.parent.orphan()
 	}
 }
 
 type trieMatcher struct {
-	root *node
-	mu   sync.RWMutex
+	root       *node
+	index      subscriptionIndex
+	watchers   *watchers
+	registry   *SubscriberRegistry
+	dictionary *wordDictionary
+	mu         sync.RWMutex
 }
 
 func NewTrieMatcher() Matcher {
 	return &trieMatcher{
 		root: &node{
 			subs:     make(map[Subscriber]struct{}),
-			children: make(map[string]*node),
+			children: make(map[uint32]*node),
 		},
+		index:      make(subscriptionIndex),
+		watchers:   newWatchers(),
+		registry:   NewSubscriberRegistry(),
+		dictionary: newWordDictionary(),
 	}
 }
 
 // Subscribe adds the Subscriber to the topic and returns a Subscription.
 func (t *trieMatcher) Subscribe(topic string, sub Subscriber) (*Subscription, error) {
+	topic = canonicalTopic(topic)
 	t.mu.Lock()
 	curr := t.root
-	for _, word := range strings.Split(topic, delimiter) {
-		child, ok := curr.children[word]
+	var buf [wordBufferSize]uint32
+	for _, id := range t.dictionary.intern(topic, buf[:0]) {
+		child, ok := curr.children[id]
 		if !ok {
 			child = &node{
-				word:     word,
+				id:       id,
 				subs:     make(map[Subscriber]struct{}),
 				parent:   curr,
-				children: make(map[string]*node),
+				children: make(map[uint32]*node),
 			}
-			curr.children[word] = child
+			curr.children[id] = child
 		}
 		curr = child
 	}
 	curr.subs[sub] = struct{}{}
+	t.indexed(topic, sub)
 	t.mu.Unlock()
 	return &Subscription{topic: topic, subscriber: sub}, nil
 }
 
+// SubscribeBytes adds the Subscriber to the topic held in the byte slice and
+// returns a Subscription. The topic is copied.
+func (t *trieMatcher) SubscribeBytes(topic []byte, sub Subscriber) (*Subscription, error) {
+	return t.Subscribe(string(topic), sub)
+}
+
+// SubscribeWords adds the Subscriber to the topic made of the words and
+// returns a Subscription.
+func (t *trieMatcher) SubscribeWords(words []string, sub Subscriber) (*Subscription, error) {
+	return t.Subscribe(joinFilter(words), sub)
+}
+
 // Unsubscribe removes the Subscription.
 func (t *trieMatcher) Unsubscribe(sub *Subscription) {
 	t.mu.Lock()
+	t.unsubscribe(sub.topic, sub.subscriber)
+	t.mu.Unlock()
+}
+
+// UnsubscribeAll removes all Subscriptions for the Subscriber.
+func (t *trieMatcher) UnsubscribeAll(sub Subscriber) {
+	t.mu.Lock()
+	for _, topic := range t.index.topics(sub) {
+		t.unsubscribe(topic, sub)
+	}
+	t.mu.Unlock()
+}
+
+// unsubscribe removes the Subscriber from the topic. The caller must hold the
+// write lock.
+func (t *trieMatcher) unsubscribe(topic string, sub Subscriber) {
 	curr := t.root
-	for _, word := range strings.Split(sub.topic, delimiter) {
-		child, ok := curr.children[word]
+	var buf [wordBufferSize]uint32
+	for _, id := range t.dictionary.lookup(topic, buf[:0]) {
+		child, ok := curr.children[id]
 		if !ok {
 			// Subscription doesn't exist.
-			t.mu.Unlock()
 			return
 		}
 		curr = child
 	}
-	delete(curr.subs, sub.subscriber)
+	delete(curr.subs, sub)
+	t.unindexed(topic, sub)
 	if len(curr.subs) == 0 && len(curr.children) == 0 {
 		curr.orphan()
 	}
+}
+
+// UnsubscribeMatching removes all Subscriptions whose topic is covered by the
+// pattern.
+func (t *trieMatcher) UnsubscribeMatching(pattern string) {
+	t.mu.Lock()
+	var buf [wordBufferSize]uint32
+	t.unsubscribePattern(t.root, t.dictionary.lookup(pattern, buf[:0]), nil, false)
 	t.mu.Unlock()
 }
 
+// UnsubscribePrefix removes all Subscriptions whose leading topic words are
+// covered by the prefix.
+func (t *trieMatcher) UnsubscribePrefix(prefix string) {
+	t.mu.Lock()
+	var buf [wordBufferSize]uint32
+	t.unsubscribePattern(t.root, t.dictionary.lookup(prefix, buf[:0]), nil, true)
+	t.mu.Unlock()
+}
+
+// unsubscribePattern removes the Subscriptions below the node which are
+// covered by the pattern. If prefix is true, every subtree the pattern leads
+// to is detached. Otherwise, only the Subscribers at the end of the pattern
+// are removed. The caller must hold the write lock.
+func (t *trieMatcher) unsubscribePattern(n *node, pattern, path []uint32, prefix bool) {
+	if len(pattern) == 0 {
+		if prefix {
+			t.unindex(n, path)
+			n.orphan()
+			return
+		}
+		if topic, ok := t.dictionary.join(path); ok {
+			for sub, _ := range n.subs {
+				t.unindexed(topic, sub)
+			}
+		}
+		n.subs = make(map[Subscriber]struct{})
+		if len(n.children) == 0 {
+			n.orphan()
+		}
+		return
+	}
+	if pattern[0] != wildcardID {
+		if child, ok := n.children[pattern[0]]; ok {
+			t.unsubscribePattern(child, pattern[1:], append(path, child.id), prefix)
+		}
+		return
+	}
+	for _, child := range n.children {
+		t.unsubscribePattern(child, pattern[1:], append(path, child.id), prefix)
+	}
+}
+
+// unindex removes every Subscription in the subtree rooted at the node from
+// the reverse index. The caller must hold the write lock.
+func (t *trieMatcher) unindex(n *node, path []uint32) {
+	topic, ok := t.dictionary.join(path)
+	if !ok {
+		// Nothing below is subscribed, or its words would be interned.
+		return
+	}
+	for sub, _ := range n.subs {
+		t.unindexed(topic, sub)
+	}
+	for _, child := range n.children {
+		t.unindex(child, append(path, child.id))
+	}
+}
+
+// indexed records the Subscription in the reverse index, notifying Watchers
+// and assigning the Subscriber an ID if it is new. Otherwise, the references
+// Subscribe took on the topic's words are given back, since the existing
+// Subscription holds its own. The caller must hold the write lock.
+func (t *trieMatcher) indexed(topic string, sub Subscriber) {
+	if t.index.add(topic, sub) {
+		t.registry.acquire(sub)
+		t.watchers.subscribed(topic)
+	} else {
+		t.dictionary.release(topic)
+	}
+}
+
+// unindexed removes the Subscription from the reverse index, notifying
+// Watchers if it was there, releasing the topic's words and releasing the
+// Subscriber's ID once it has no Subscriptions left. The caller must hold the
+// write lock.
+func (t *trieMatcher) unindexed(topic string, sub Subscriber) {
+	if t.index.remove(topic, sub) {
+		t.dictionary.release(topic)
+		t.watchers.unsubscribed(topic)
+		t.registry.release(sub)
+	}
+}
+
+// Topics returns the topics the Subscriber is subscribed to.
+func (t *trieMatcher) Topics(sub Subscriber) []string {
+	t.mu.RLock()
+	topics := t.index.topics(sub)
+	t.mu.RUnlock()
+	return topics
+}
+
+// Watch returns a Watcher which receives filter-level change Events.
+func (t *trieMatcher) Watch() *Watcher {
+	return t.watchers.watch()
+}
+
 // Lookup returns the Subscribers for the given topic.
 func (t *trieMatcher) Lookup(topic string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return t.lookupIDs(t.dictionary.lookup(topic, buf[:0]))
+}
+
+// lookupIDs returns the Subscribers for the topic made of the words with the
+// given IDs.
+func (t *trieMatcher) lookupIDs(words []uint32) []Subscriber {
 	t.mu.RLock()
 	var (
-		subMap = t.lookup(strings.Split(topic, delimiter), t.root)
+		subMap = t.lookup(words, t.root)
 		subs   = make([]Subscriber, len(subMap))
 		i      = 0
 	)
@@ -95,7 +248,20 @@ func (t *trieMatcher) Lookup(topic string) []Subscriber {
 	return subs
 }
 
-func (t *trieMatcher) lookup(words []string, node *node) map[Subscriber]struct{} {
+// LookupBytes returns the Subscribers for the topic held in the byte slice
+// without copying or retaining it.
+func (t *trieMatcher) LookupBytes(topic []byte) []Subscriber {
+	return t.Lookup(bytesToString(topic))
+}
+
+// LookupWords returns the Subscribers for the topic made of the words.
+func (t *trieMatcher) LookupWords(words []string) []Subscriber {
+	var buf [wordBufferSize]uint32
+	return t.lookupIDs(t.dictionary.lookupWords(words, buf[:0]))
+}
+
+// lookup returns the Subscribers below the node for the topic word IDs.
+func (t *trieMatcher) lookup(words []uint32, node *node) map[Subscriber]struct{} {
 	if len(words) == 0 {
 		return node.subs
 	}
@@ -105,10 +271,67 @@ func (t *trieMatcher) lookup(words []string, node *node) map[Subscriber]struct{}
 			subs[k] = v
 		}
 	}
-	if n, ok := node.children[wildcard]; ok {
+	if n, ok := node.children[wildcardID]; ok {
 		for k, v := range t.lookup(words[1:], n) {
 			subs[k] = v
 		}
 	}
 	return subs
 }
+
+// LookupBitmap returns the IDs of the Subscribers for the given topic.
+func (t *trieMatcher) LookupBitmap(topic string) *roaring.Bitmap {
+	t.mu.RLock()
+	// The lookup may return a node's own set, so it is read under the lock.
+	var buf [wordBufferSize]uint32
+	bitmap := t.registry.bitmap(t.lookup(t.dictionary.lookup(topic, buf[:0]), t.root))
+	t.mu.RUnlock()
+	return bitmap
+}
+
+// Registry returns the SubscriberRegistry which assigns Subscriber IDs.
+func (t *trieMatcher) Registry() *SubscriberRegistry {
+	return t.registry
+}
+
+// LookupPattern returns the Subscribers whose topic overlaps the filter.
+func (t *trieMatcher) LookupPattern(filter string) []Subscriber {
+	subMap := make(map[Subscriber]struct{})
+	t.mu.RLock()
+	var buf [wordBufferSize]uint32
+	t.lookupPattern(t.dictionary.lookup(filter, buf[:0]), t.root, subMap)
+	t.mu.RUnlock()
+	var (
+		subs = make([]Subscriber, len(subMap))
+		i    = 0
+	)
+	for sub, _ := range subMap {
+		subs[i] = sub
+		i++
+	}
+	return subs
+}
+
+// lookupPattern adds the Subscribers below the node whose topics overlap the
+// filter word IDs to subs. Every child is followed where the filter has a
+// wildcard.
+func (t *trieMatcher) lookupPattern(words []uint32, node *node, subs map[Subscriber]struct{}) {
+	if len(words) == 0 {
+		for sub, _ := range node.subs {
+			subs[sub] = struct{}{}
+		}
+		return
+	}
+	if words[0] == wildcardID {
+		for _, child := range node.children {
+			t.lookupPattern(words[1:], child, subs)
+		}
+		return
+	}
+	if n, ok := node.children[words[0]]; ok {
+		t.lookupPattern(words[1:], n, subs)
+	}
+	if n, ok := node.children[wildcardID]; ok {
+		t.lookupPattern(words[1:], n, subs)
+	}
+}
@@ -92,6 +92,38 @@ func BenchmarkTrieMatcherLookup(b *testing.B) {
 	}
 }
 
+func BenchmarkTrieMatcherLookupBytes(b *testing.B) {
+	var (
+		m     = NewTrieMatcher()
+		s0    = 0
+		topic = []byte("foo.bar.baz.qux.quux")
+	)
+	m.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(m, 1000, 5)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.LookupBytes(topic)
+	}
+}
+
+func BenchmarkTrieMatcherLookupWords(b *testing.B) {
+	var (
+		m     = NewTrieMatcher()
+		s0    = 0
+		words = []string{"foo", "bar", "baz", "qux", "quux"}
+	)
+	m.Subscribe("foo.*.baz.qux.quux", s0)
+	populateMatcher(m, 1000, 5)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.LookupWords(words)
+	}
+}
+
 func BenchmarkTrieMatcherSubscribeCold(b *testing.B) {
 	var (
 		m  = NewTrieMatcher()
@@ -2,9 +2,11 @@ package matching
 
 import (
 	"math/rand"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -28,6 +30,15 @@ func populateMatcher(m Matcher, num, topicSize int) {
 	}
 }
 
+// populateWideMatcher subscribes to width topics which share a first word, so
+// that the second level of the topic space has width children.
+func populateWideMatcher(m Matcher, prefix string, width int) {
+	for i := 0; i < width; i++ {
+		topic := prefix + "." + strconv.Itoa(i)
+		m.Subscribe(topic, Subscriber(topic))
+	}
+}
+
 func benchmark5050(b *testing.B, numItems, numThreads int, factory func([][]string) Matcher) {
 	itemsToInsert := make([][]string, 0, numThreads)
 	for i := 0; i < numThreads; i++ {
@@ -101,3 +112,463 @@ func benchmark9010(b *testing.B, numItems, numThreads int, factory func([][]stri
 		wg.Wait()
 	}
 }
+
+func assertTopics(assert *assert.Assertions, expected, actual []string) {
+	assert.Len(actual, len(expected))
+	for _, topic := range expected {
+		assert.Contains(actual, topic)
+	}
+}
+
+func testUnsubscribeAll(assert *assert.Assertions, m Matcher) {
+	var (
+		s0 = 0
+		s1 = 1
+	)
+
+	_, err := m.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("forex.eur", s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("trade", s0)
+	assert.NoError(err)
+	sub3, err := m.Subscribe("forex.eur", s1)
+	assert.NoError(err)
+
+	assertTopics(assert, []string{"forex.*", "forex.eur", "trade"}, m.Topics(s0))
+	assertTopics(assert, []string{"forex.eur"}, m.Topics(s1))
+
+	m.UnsubscribeAll(s0)
+
+	assertTopics(assert, []string{}, m.Topics(s0))
+	assertTopics(assert, []string{"forex.eur"}, m.Topics(s1))
+	assertEqual(assert, []Subscriber{s1}, m.Lookup("forex.eur"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.usd"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("trade"))
+
+	m.Unsubscribe(sub3)
+
+	assertTopics(assert, []string{}, m.Topics(s1))
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.eur"))
+}
+
+func testUnsubscribePattern(assert *assert.Assertions, m Matcher) {
+	var (
+		s0 = 0
+		s1 = 1
+		s2 = 2
+		s3 = 3
+		s4 = 4
+	)
+
+	_, err := m.Subscribe("tenant42.a.b", s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("tenant42.*.c", s1)
+	assert.NoError(err)
+	_, err = m.Subscribe("tenant42.a", s2)
+	assert.NoError(err)
+	_, err = m.Subscribe("tenant42.a.b.c", s3)
+	assert.NoError(err)
+	_, err = m.Subscribe("tenant7.a.b", s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("*.a.b", s4)
+	assert.NoError(err)
+
+	m.UnsubscribeMatching("tenant42.*.*")
+
+	assertEqual(assert, []Subscriber{s4}, m.Lookup("tenant42.a.b"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("tenant42.x.c"))
+	assertEqual(assert, []Subscriber{s2}, m.Lookup("tenant42.a"))
+	assertEqual(assert, []Subscriber{s3}, m.Lookup("tenant42.a.b.c"))
+	assertTopics(assert, []string{"tenant7.a.b"}, m.Topics(s0))
+	assertTopics(assert, []string{}, m.Topics(s1))
+
+	m.UnsubscribePrefix("tenant42")
+
+	assertEqual(assert, []Subscriber{}, m.Lookup("tenant42.a"))
+	assertEqual(assert, []Subscriber{}, m.Lookup("tenant42.a.b.c"))
+	assertEqual(assert, []Subscriber{s0, s4}, m.Lookup("tenant7.a.b"))
+	assertTopics(assert, []string{}, m.Topics(s2))
+	assertTopics(assert, []string{}, m.Topics(s3))
+
+	m.UnsubscribePrefix("*.a")
+
+	assertEqual(assert, []Subscriber{}, m.Lookup("tenant7.a.b"))
+	assertTopics(assert, []string{}, m.Topics(s0))
+	assertTopics(assert, []string{}, m.Topics(s4))
+
+	_, err = m.Subscribe("tenant42.a.b", s0)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s0}, m.Lookup("tenant42.a.b"))
+}
+
+// testConcurrentResubscribe races Subscribe against Unsubscribe of the same
+// Subscription and checks that the reverse index agrees with the trie after
+// each round.
+func testConcurrentResubscribe(assert *assert.Assertions, m Matcher) {
+	const topic = "race.a"
+	sub, err := m.Subscribe(topic, 0)
+	assert.NoError(err)
+	for i := 0; i < 1000; i++ {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := m.Subscribe(topic, 0)
+			assert.NoError(err)
+		}()
+		go func() {
+			defer wg.Done()
+			m.Unsubscribe(sub)
+		}()
+		wg.Wait()
+
+		if len(m.Lookup(topic)) == 1 {
+			assertTopics(assert, []string{topic}, m.Topics(0))
+		} else {
+			assertTopics(assert, []string{}, m.Topics(0))
+		}
+	}
+}
+
+// testConcurrentLearning races Lookups, which learn a topic, against
+// RemoveTopic and Unsubscribe of its only Subscription, and checks that a
+// Lookup never returns a Subscriber which was freed under it.
+func testConcurrentLearning(assert *assert.Assertions, m TopicSpaceMatcher) {
+	const topic = "learn.a"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			sub, err := m.Subscribe(topic, i+1)
+			assert.NoError(err)
+			m.RemoveTopic(topic)
+			m.Unsubscribe(sub)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for _, sub := range m.Lookup(topic) {
+			assert.NotNil(sub)
+		}
+	}
+}
+
+// testConcurrentWatch churns Subscriptions to a few filters from several
+// goroutines while a Watcher follows along, and checks that the Watcher's
+// Events are consistent and leave it with the filters which end up
+// subscribed.
+func testConcurrentWatch(assert *assert.Assertions, m Matcher) {
+	var (
+		filters = []string{"w.a", "w.b", "w.*"}
+		w       = m.Watch()
+		wg      sync.WaitGroup
+	)
+	defer w.Close()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				sub, err := m.Subscribe(filters[(i+j)%len(filters)], i)
+				assert.NoError(err)
+				if j%7 != 0 {
+					m.Unsubscribe(sub)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	expected := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		for _, topic := range m.Topics(i) {
+			expected[topic] = true
+		}
+	}
+	var (
+		seen = make(map[string]bool)
+		seq  uint64
+	)
+	for !reflect.DeepEqual(seen, expected) {
+		e := nextEvent(assert, w)
+		if e == (Event{}) {
+			return
+		}
+		assert.Equal(seq+1, e.Seq)
+		seq = e.Seq
+		switch e.Type {
+		case FilterAdded:
+			assert.False(seen[e.Filter], e.Filter)
+			seen[e.Filter] = true
+		case FilterRemoved:
+			assert.True(seen[e.Filter], e.Filter)
+			delete(seen, e.Filter)
+		}
+	}
+}
+
+func nextEvent(assert *assert.Assertions, w *Watcher) Event {
+	select {
+	case e := <-w.Events():
+		return e
+	case <-time.After(5 * time.Second):
+		assert.Fail("timed out waiting for event")
+		return Event{}
+	}
+}
+
+func testWatch(assert *assert.Assertions, m Matcher) {
+	var (
+		s0 = 0
+		s1 = 1
+	)
+
+	sub0, err := m.Subscribe("a.b", s0)
+	assert.NoError(err)
+
+	w := m.Watch()
+	defer w.Close()
+	assert.Equal(Event{Type: FilterAdded, Filter: "a.b", Seq: 1}, nextEvent(assert, w))
+
+	sub1, err := m.Subscribe("a.b", s1)
+	assert.NoError(err)
+	_, err = m.Subscribe("a.*", s0)
+	assert.NoError(err)
+	assert.Equal(Event{Type: FilterAdded, Filter: "a.*", Seq: 2}, nextEvent(assert, w))
+
+	m.Unsubscribe(sub0)
+	m.Unsubscribe(sub1)
+	assert.Equal(Event{Type: FilterRemoved, Filter: "a.b", Seq: 3}, nextEvent(assert, w))
+
+	m.UnsubscribeAll(s0)
+	assert.Equal(Event{Type: FilterRemoved, Filter: "a.*", Seq: 4}, nextEvent(assert, w))
+
+	w.Close()
+	_, ok := <-w.Events()
+	assert.False(ok)
+}
+
+func testLookupPattern(assert *assert.Assertions, m Matcher) {
+	var (
+		s0 = 0
+		s1 = 1
+		s2 = 2
+		s3 = 3
+		s4 = 4
+		s5 = 5
+	)
+
+	_, err := m.Subscribe("orders.new.eu", s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("orders.*.us", s1)
+	assert.NoError(err)
+	_, err = m.Subscribe("orders.*.*", s2)
+	assert.NoError(err)
+	_, err = m.Subscribe("*.new.eu", s3)
+	assert.NoError(err)
+	_, err = m.Subscribe("orders.new", s4)
+	assert.NoError(err)
+	_, err = m.Subscribe("trade.new.eu", s5)
+	assert.NoError(err)
+
+	assertEqual(assert, []Subscriber{s0, s2, s3}, m.LookupPattern("orders.*.eu"))
+	assertEqual(assert, []Subscriber{s1, s2}, m.LookupPattern("*.*.us"))
+	assertEqual(assert, []Subscriber{s0, s1, s2, s3, s5}, m.LookupPattern("*.*.*"))
+	assertEqual(assert, []Subscriber{s4}, m.LookupPattern("*.new"))
+	assertEqual(assert, []Subscriber{}, m.LookupPattern("*"))
+	assertEqual(assert, []Subscriber{s0, s2, s3}, m.LookupPattern("orders.new.eu"))
+}
+
+func testCompact(assert *assert.Assertions, m Matcher) {
+	subs := make([]*Subscription, 10)
+	for i := range subs {
+		sub, err := m.Subscribe("forex.*", i)
+		assert.NoError(err)
+		subs[i] = sub
+	}
+	for i := 0; i < len(subs); i += 2 {
+		m.Unsubscribe(subs[i])
+	}
+
+	m.(Compactor).Compact()
+	assertEqual(assert, []Subscriber{1, 3, 5, 7, 9}, m.Lookup("forex.eur"))
+
+	// Handles issued before compaction still work, including ones which
+	// were already unsubscribed.
+	m.Unsubscribe(subs[0])
+	m.Unsubscribe(subs[1])
+	assertEqual(assert, []Subscriber{3, 5, 7, 9}, m.Lookup("forex.eur"))
+
+	sub10, err := m.Subscribe("forex.eur", 10)
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{3, 5, 7, 9, 10}, m.Lookup("forex.eur"))
+
+	m.(Compactor).Compact()
+	m.Unsubscribe(subs[3])
+	m.Unsubscribe(sub10)
+	assertEqual(assert, []Subscriber{5, 7, 9}, m.Lookup("forex.eur"))
+	assertTopics(assert, []string{"forex.*"}, m.Topics(5))
+
+	m.UnsubscribeAll(5)
+	m.Unsubscribe(subs[7])
+	m.Unsubscribe(subs[9])
+	assertEqual(assert, []Subscriber{}, m.Lookup("forex.eur"))
+}
+
+func testLookupBitmap(assert *assert.Assertions, m Matcher) {
+	bm, ok := m.(BitmapMatcher)
+	if !assert.True(ok) {
+		return
+	}
+	var (
+		registry = bm.Registry()
+		s0       = "s0"
+		s1       = "s1"
+		s2       = "s2"
+	)
+
+	_, err := m.Subscribe("forex.*", s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("forex.eur", s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("*.eur", s1)
+	assert.NoError(err)
+	_, err = m.Subscribe("forex.usd", s2)
+	assert.NoError(err)
+
+	ids := bm.LookupBitmap("forex.eur")
+	assert.Equal(uint64(2), ids.GetCardinality())
+	for _, sub := range []Subscriber{s0, s1} {
+		id, ok := registry.ID(sub)
+		assert.True(ok)
+		assert.True(ids.Contains(id))
+	}
+	assertEqual(assert, m.Lookup("forex.eur"), registry.Subscribers(ids))
+
+	online := registry.Bitmap([]Subscriber{s1, s2})
+	ids.And(online)
+	assertEqual(assert, []Subscriber{s1}, registry.Subscribers(ids))
+
+	// The result is owned by the caller.
+	assertEqual(assert, []Subscriber{s0, s1}, registry.Subscribers(bm.LookupBitmap("forex.eur")))
+	assert.True(bm.LookupBitmap("trade.usd").IsEmpty())
+
+	// A Subscriber's ID is released with its last Subscription.
+	id, _ := registry.ID(s0)
+	stale := bm.LookupBitmap("forex.eur")
+	m.UnsubscribeAll(s0)
+	_, ok = registry.Subscriber(id)
+	assert.False(ok)
+	_, ok = registry.ID(s0)
+	assert.False(ok)
+
+	// IDs aren't reused, so bitmaps held past an UnsubscribeAll only resolve
+	// to the Subscribers which are still subscribed.
+	_, err = m.Subscribe("forex.eur", "s3")
+	assert.NoError(err)
+	assertEqual(assert, []Subscriber{s1}, registry.Subscribers(stale))
+	assertEqual(assert, []Subscriber{s1, "s3"}, registry.Subscribers(bm.LookupBitmap("forex.eur")))
+}
+
+func testBytes(assert *assert.Assertions, m Matcher) {
+	var (
+		s0  = 0
+		s1  = 1
+		buf = []byte("bytes.a.c")
+	)
+
+	_, err := m.SubscribeBytes(buf, s0)
+	assert.NoError(err)
+	copy(buf, "bytes.*.c")
+	_, err = m.SubscribeBytes(buf, s1)
+	assert.NoError(err)
+
+	// The buffer is reused once each call returns, as a network read buffer
+	// would be.
+	copy(buf, "bytes.a.c")
+	assertEqual(assert, []Subscriber{s0, s1}, m.LookupBytes(buf))
+	copy(buf, "bytes.b.c")
+	assertEqual(assert, []Subscriber{s1}, m.LookupBytes(buf))
+	copy(buf, "bytes.x.y")
+	assertEqual(assert, []Subscriber{}, m.LookupBytes(buf))
+	assertEqual(assert, []Subscriber{}, m.LookupBytes(nil))
+
+	assertTopics(assert, []string{"bytes.a.c"}, m.Topics(s0))
+	assertTopics(assert, []string{"bytes.*.c"}, m.Topics(s1))
+	assertEqual(assert, []Subscriber{s1}, m.Lookup("bytes.b.c"))
+}
+
+func testWords(assert *assert.Assertions, m Matcher) {
+	var (
+		s0 = 0
+		s1 = 1
+		s2 = 2
+		s3 = 3
+	)
+
+	sub0, err := m.SubscribeWords([]string{"files", "report.pdf"}, s0)
+	assert.NoError(err)
+	_, err = m.SubscribeWords([]string{"files", wildcard}, s1)
+	assert.NoError(err)
+	_, err = m.Subscribe("files.report", s2)
+	assert.NoError(err)
+	_, err = m.SubscribeWords([]string{"files", `c:\tmp`}, s3)
+	assert.NoError(err)
+
+	// Words may contain the delimiter, which is escaped in their topic.
+	assertEqual(assert, []Subscriber{s0, s1}, m.LookupWords([]string{"files", "report.pdf"}))
+	assertEqual(assert, []Subscriber{s0, s1}, m.Lookup(`files.report\.pdf`))
+	assertEqual(assert, []Subscriber{}, m.Lookup("files.report.pdf"))
+	assertEqual(assert, []Subscriber{s1, s2}, m.LookupWords([]string{"files", "report"}))
+	assertEqual(assert, []Subscriber{s1, s3}, m.LookupWords([]string{"files", `c:\tmp`}))
+	assertEqual(assert, []Subscriber{s1, s3}, m.Lookup(`files.c:\\tmp`))
+	assertEqual(assert, []Subscriber{}, m.LookupWords([]string{"files"}))
+	assertTopics(assert, []string{`files.report\.pdf`}, m.Topics(s0))
+	assertTopics(assert, []string{`files.c:\\tmp`}, m.Topics(s3))
+
+	m.Unsubscribe(sub0)
+	assertEqual(assert, []Subscriber{s1}, m.LookupWords([]string{"files", "report.pdf"}))
+	m.UnsubscribeMatching(`files.c:\\tmp`)
+	assertEqual(assert, []Subscriber{s1}, m.LookupWords([]string{"files", `c:\tmp`}))
+}
+
+func testEscapes(assert *assert.Assertions, m Matcher) {
+	var (
+		s0 = 0
+		s1 = 1
+		s2 = 2
+		s3 = 3
+	)
+
+	_, err := m.Subscribe(JoinWords("glob", wildcard), s0)
+	assert.NoError(err)
+	_, err = m.Subscribe("glob.*", s1)
+	assert.NoError(err)
+	_, err = m.Subscribe(JoinWords("glob", "a.b"), s2)
+	assert.NoError(err)
+	// A "*" within a longer word needn't be escaped, but may be.
+	_, err = m.Subscribe(`glob.a\*b`, s3)
+	assert.NoError(err)
+
+	// A literal "*" word is only matched by itself and wildcards.
+	assertEqual(assert, []Subscriber{s0, s1}, m.Lookup(`glob.\*`))
+	assertEqual(assert, []Subscriber{s0, s1}, m.LookupWords([]string{"glob", wildcard}))
+	assertEqual(assert, []Subscriber{s1}, m.Lookup("glob.x"))
+	assertEqual(assert, []Subscriber{s1, s2}, m.Lookup(`glob.a\.b`))
+	assertEqual(assert, []Subscriber{}, m.Lookup("glob.a.b"))
+	assertEqual(assert, []Subscriber{s1, s3}, m.Lookup("glob.a*b"))
+	assertEqual(assert, []Subscriber{s1, s3}, m.Lookup(`glob.a\*b`))
+	assertTopics(assert, []string{"glob.a*b"}, m.Topics(s3))
+
+	m.UnsubscribeMatching(`glob.\*`)
+	assertEqual(assert, []Subscriber{s1}, m.Lookup(`glob.\*`))
+	m.UnsubscribeMatching(`glob.a\.b`)
+	assertEqual(assert, []Subscriber{s1}, m.Lookup(`glob.a\.b`))
+	assertEqual(assert, []Subscriber{s1, s3}, m.Lookup("glob.a*b"))
+}
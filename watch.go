@@ -0,0 +1,209 @@
+package matching
+
+import "sync"
+
+// EventType indicates the kind of change an Event describes.
+type EventType int
+
+const (
+	// FilterAdded indicates a filter gained its first Subscription.
+	FilterAdded EventType = iota
+
+	// FilterRemoved indicates a filter lost its last Subscription.
+	FilterRemoved
+)
+
+// Event is a filter-level change in a Matcher's subscriptions. Events are
+// only emitted when a filter gains its first or loses its last Subscription,
+// so churn among Subscribers to a filter which remains subscribed is not
+// reported.
+type Event struct {
+	Type   EventType
+	Filter string
+
+	// Seq is the position of the change in the Matcher's change stream. It
+	// increases by one with each change. The Events a Watcher receives for
+	// existing filters when it starts all carry the current position.
+	Seq uint64
+}
+
+// Watcher receives the Events of a Matcher in order. Events are queued
+// without bound so that a slow Watcher never blocks the Matcher.
+type Watcher struct {
+	events chan Event
+	done   chan struct{}
+	queue  []Event
+	closed bool
+	hub    *watchers
+	mu     sync.Mutex
+	cond   *sync.Cond
+
+	// onClose, if set, is called once when the Watcher is closed.
+	onClose func()
+}
+
+func newWatcher(hub *watchers) *Watcher {
+	w := &Watcher{
+		events: make(chan Event),
+		done:   make(chan struct{}),
+		hub:    hub,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	go w.dispatch()
+	return w
+}
+
+// Events returns the channel on which Events are delivered. It is closed when
+// the Watcher is closed.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Close stops the Watcher. Queued Events which have not been received are
+// discarded.
+func (w *Watcher) Close() {
+	w.hub.remove(w)
+	w.mu.Lock()
+	closing := !w.closed
+	if closing {
+		w.closed = true
+		close(w.done)
+		w.cond.Signal()
+	}
+	w.mu.Unlock()
+	if closing && w.onClose != nil {
+		w.onClose()
+	}
+}
+
+// enqueue adds the Event to the Watcher's queue.
+func (w *Watcher) enqueue(e Event) {
+	w.mu.Lock()
+	w.queue = append(w.queue, e)
+	w.cond.Signal()
+	w.mu.Unlock()
+}
+
+// dispatch delivers queued Events until the Watcher is closed.
+func (w *Watcher) dispatch() {
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		e := w.queue[0]
+		w.queue[0] = Event{}
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.events <- e:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// watchers counts the Subscriptions to each filter of a Matcher and notifies
+// Watchers when a filter gains its first or loses its last Subscription. It
+// is safe for concurrent use.
+type watchers struct {
+	counts   map[string]int
+	seq      uint64
+	watchers map[*Watcher]struct{}
+	mu       sync.Mutex
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		counts:   make(map[string]int),
+		watchers: make(map[*Watcher]struct{}),
+	}
+}
+
+// subscribed records a new Subscription to the filter.
+func (w *watchers) subscribed(filter string) {
+	w.mu.Lock()
+	w.counts[filter]++
+	if w.counts[filter] == 1 {
+		w.notify(FilterAdded, filter)
+	}
+	w.mu.Unlock()
+}
+
+// unsubscribed records the removal of a Subscription to the filter.
+func (w *watchers) unsubscribed(filter string) {
+	w.mu.Lock()
+	if count, ok := w.counts[filter]; ok {
+		if count > 1 {
+			w.counts[filter] = count - 1
+		} else {
+			delete(w.counts, filter)
+			w.notify(FilterRemoved, filter)
+		}
+	}
+	w.mu.Unlock()
+}
+
+// sync records whether the filter has Subscriptions, as reported by present,
+// notifying Watchers if that changed. It is used by matchers which don't
+// count Subscriptions under a lock of their own. They call sync after any
+// change which may have given the filter its first or taken its last
+// Subscription. present is called under the lock, so whichever call comes
+// last sees the filter's final state however the calls interleave.
+func (w *watchers) sync(filter string, present func() bool) {
+	w.mu.Lock()
+	_, had := w.counts[filter]
+	switch has := present(); {
+	case has && !had:
+		w.counts[filter] = 1
+		w.notify(FilterAdded, filter)
+	case had && !has:
+		delete(w.counts, filter)
+		w.notify(FilterRemoved, filter)
+	}
+	w.mu.Unlock()
+}
+
+// notify sends an Event to every Watcher. The caller must hold the lock.
+func (w *watchers) notify(typ EventType, filter string) {
+	w.seq++
+	e := Event{Type: typ, Filter: filter, Seq: w.seq}
+	for watcher, _ := range w.watchers {
+		watcher.enqueue(e)
+	}
+}
+
+// watch returns a new Watcher. The Watcher first receives a FilterAdded Event
+// for every filter which currently has Subscriptions.
+func (w *watchers) watch() *Watcher {
+	watcher := newWatcher(w)
+	w.mu.Lock()
+	for filter, _ := range w.counts {
+		watcher.enqueue(Event{Type: FilterAdded, Filter: filter, Seq: w.seq})
+	}
+	w.watchers[watcher] = struct{}{}
+	w.mu.Unlock()
+	return watcher
+}
+
+// reset forgets the Subscription counts, keeping the change stream's
+// position. It is used when the counts are rebuilt from another Matcher's
+// Events.
+func (w *watchers) reset() {
+	w.mu.Lock()
+	w.counts = make(map[string]int)
+	w.mu.Unlock()
+}
+
+// remove stops sending Events to the Watcher.
+func (w *watchers) remove(watcher *Watcher) {
+	w.mu.Lock()
+	delete(w.watchers, watcher)
+	w.mu.Unlock()
+}
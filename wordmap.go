@@ -0,0 +1,194 @@
+package matching
+
+import "math/bits"
+
+// wordMap is a persistent hash array mapped trie of interned words. It
+// is laid out like hamt, but keyed by a 64-bit hash of the word, and is never
+// modified in place, so readers can use a published wordMap without locking.
+// The hash is supplied by the caller. The zero value is empty.
+type wordMap struct {
+	root *wordMapNode
+}
+
+// wordMapNode is an internal node of a wordMap. Each set bit in the bitmap is
+// a slot holding either a hash or a child node, and entries holds the
+// occupied slots in order.
+type wordMapNode struct {
+	bitmap  uint32
+	entries []wordMapEntry
+}
+
+// wordMapEntry is a slot of a wordMapNode. It holds a child node if child is
+// set and otherwise the words with the hash. Distinct words rarely share all
+// 64 hash bits, so words almost always holds a single word.
+type wordMapEntry struct {
+	hash  uint64
+	words []*internedWord
+	child *wordMapNode
+}
+
+// slot returns the bitmap bit and entry index for the hash at the given
+// shift.
+func (n *wordMapNode) slot(hash uint64, shift uint) (uint32, int) {
+	bit := uint32(1) << ((hash >> shift) & (1<<hamtBits - 1))
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+// clone returns a copy of the node with its own entries.
+func (n *wordMapNode) clone() *wordMapNode {
+	entries := make([]wordMapEntry, len(n.entries))
+	copy(entries, n.entries)
+	return &wordMapNode{bitmap: n.bitmap, entries: entries}
+}
+
+// get returns the interned word with the hash, or nil if the word isn't in
+// the map.
+func (m wordMap) get(hash uint64, word string) *internedWord {
+	var (
+		n     = m.root
+		shift uint
+	)
+	for n != nil {
+		bit, idx := n.slot(hash, shift)
+		if n.bitmap&bit == 0 {
+			return nil
+		}
+		e := &n.entries[idx]
+		if e.child == nil {
+			if e.hash == hash {
+				for _, w := range e.words {
+					if w.word == word {
+						return w
+					}
+				}
+			}
+			return nil
+		}
+		n = e.child
+		shift += hamtBits
+	}
+	return nil
+}
+
+// with returns a copy of the map holding the interned word, whose hash is
+// given, in place of any other with the same word.
+func (m wordMap) with(hash uint64, w *internedWord) wordMap {
+	root := m.root
+	if root == nil {
+		root = &wordMapNode{}
+	}
+	entry := wordMapEntry{hash: hash, words: []*internedWord{w}}
+	return wordMap{root: root.insert(entry, 0)}
+}
+
+// insert returns a copy of the node with the entry's words added, replacing
+// any with the same words.
+func (n *wordMapNode) insert(entry wordMapEntry, shift uint) *wordMapNode {
+	bit, idx := n.slot(entry.hash, shift)
+	if n.bitmap&bit == 0 {
+		entries := make([]wordMapEntry, len(n.entries)+1)
+		copy(entries, n.entries[:idx])
+		entries[idx] = entry
+		copy(entries[idx+1:], n.entries[idx:])
+		return &wordMapNode{bitmap: n.bitmap | bit, entries: entries}
+	}
+
+	var (
+		c = n.clone()
+		e = n.entries[idx]
+	)
+	switch {
+	case e.child != nil:
+		c.entries[idx].child = e.child.insert(entry, shift+hamtBits)
+	case e.hash == entry.hash:
+		words := make([]*internedWord, 0, len(e.words)+len(entry.words))
+		for _, w := range e.words {
+			if !containsWord(entry.words, w.word) {
+				words = append(words, w)
+			}
+		}
+		c.entries[idx].words = append(words, entry.words...)
+	default:
+		// Two hashes share the slot, so push both down a level. Since the
+		// hashes differ in some bit, they part by the last level.
+		child := (&wordMapNode{}).insert(e, shift+hamtBits)
+		c.entries[idx] = wordMapEntry{child: child.insert(entry, shift+hamtBits)}
+	}
+	return c
+}
+
+// containsWord indicates if the word is among the words.
+func containsWord(words []*internedWord, word string) bool {
+	for _, w := range words {
+		if w.word == word {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns a copy of the map with the word with the hash removed.
+func (m wordMap) without(hash uint64, word string) wordMap {
+	if m.root == nil {
+		return m
+	}
+	root, removed := m.root.remove(hash, 0, word)
+	if !removed {
+		return m
+	}
+	return wordMap{root: root}
+}
+
+// remove returns a copy of the node without the word and whether the word was
+// present. A nil node is returned if the node is left empty.
+func (n *wordMapNode) remove(hash uint64, shift uint, word string) (*wordMapNode, bool) {
+	bit, idx := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	e := n.entries[idx]
+	if e.child == nil {
+		if e.hash != hash || !containsWord(e.words, word) {
+			return n, false
+		}
+		if len(e.words) == 1 {
+			return n.removedEntry(bit, idx), true
+		}
+		words := make([]*internedWord, 0, len(e.words)-1)
+		for _, w := range e.words {
+			if w.word != word {
+				words = append(words, w)
+			}
+		}
+		c := n.clone()
+		c.entries[idx].words = words
+		return c, true
+	}
+	child, removed := e.child.remove(hash, shift+hamtBits, word)
+	if !removed {
+		return n, false
+	}
+	if child == nil {
+		return n.removedEntry(bit, idx), true
+	}
+	c := n.clone()
+	if len(child.entries) == 1 && child.entries[0].child == nil {
+		// Pull a lone hash back up so that paths stay as short as possible.
+		c.entries[idx] = child.entries[0]
+	} else {
+		c.entries[idx].child = child
+	}
+	return c, true
+}
+
+// removedEntry returns a copy of the node without the entry at the index and
+// its bitmap bit, or nil if it was the only entry.
+func (n *wordMapNode) removedEntry(bit uint32, idx int) *wordMapNode {
+	if len(n.entries) == 1 {
+		return nil
+	}
+	entries := make([]wordMapEntry, 0, len(n.entries)-1)
+	entries = append(entries, n.entries[:idx]...)
+	entries = append(entries, n.entries[idx+1:]...)
+	return &wordMapNode{bitmap: n.bitmap &^ bit, entries: entries}
+}
@@ -0,0 +1,90 @@
+package matching
+
+import (
+	"hash/maphash"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWordMap(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		m        wordMap
+		seed     = maphash.MakeSeed()
+		expected = make(map[string]uint32)
+	)
+	with := func(m wordMap, word string, id uint32) wordMap {
+		return m.with(maphash.String(seed, word), &internedWord{word: word, id: id})
+	}
+
+	for i := 0; i < 5000; i++ {
+		word := strconv.Itoa(i)
+		m = with(m, word, uint32(i))
+		expected[word] = uint32(i)
+	}
+	// Replacing a word keeps a single entry for it.
+	m = with(m, "42", 7)
+	expected["42"] = 7
+
+	before := m
+	for i := 0; i < 5000; i += 3 {
+		word := strconv.Itoa(i)
+		m = m.without(maphash.String(seed, word), word)
+		delete(expected, word)
+	}
+	m = m.without(maphash.String(seed, "5000"), "5000")
+
+	for word, id := range expected {
+		got := m.get(maphash.String(seed, word), word)
+		if assert.NotNil(got, word) {
+			assert.Equal(id, got.id, word)
+		}
+	}
+	assert.Nil(m.get(maphash.String(seed, "0"), "0"))
+
+	// Earlier versions are unaffected by later writes.
+	got := before.get(maphash.String(seed, "0"), "0")
+	if assert.NotNil(got) {
+		assert.Equal(uint32(0), got.id)
+	}
+
+	for word := range expected {
+		m = m.without(maphash.String(seed, word), word)
+	}
+	assert.Nil(m.root)
+}
+
+// Ensures words with the same hash, or hashes which only differ in their last
+// bits, are kept apart.
+func TestWordMapCollisions(t *testing.T) {
+	assert := assert.New(t)
+	var m wordMap
+	with := func(hash uint64, word string, id uint32) {
+		m = m.with(hash, &internedWord{word: word, id: id})
+	}
+	assertID := func(id uint32, hash uint64, word string) {
+		if got := m.get(hash, word); assert.NotNil(got, word) {
+			assert.Equal(id, got.id, word)
+		}
+	}
+
+	with(1, "a", 2)
+	with(1, "b", 3)
+	with(1|1<<63, "c", 4)
+	with(1, "a", 5)
+
+	assertID(5, 1, "a")
+	assertID(3, 1, "b")
+	assertID(4, 1|1<<63, "c")
+	assert.Nil(m.get(1, "c"))
+
+	m = m.without(1, "a")
+	assert.Nil(m.get(1, "a"))
+	assertID(3, 1, "b")
+
+	m = m.without(1, "b")
+	m = m.without(1|1<<63, "c")
+	assert.Nil(m.root)
+}